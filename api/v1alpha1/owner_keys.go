@@ -0,0 +1,91 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// OwnerKeysAnnotation holds the comma separated Ed25519 public keys,
+	// base64url encoded, with which requests managing the service may be signed
+	OwnerKeysAnnotation = "codius.org/owner-keys"
+	// OwnerLabelPrefix prefixes the labels identifying the owners of a service
+	OwnerLabelPrefix = "owner.codius.org/"
+)
+
+// OwnerLabel returns the label identifying services managed with the token or
+// owner key. The label holds an unsalted digest so that services can be
+// listed by owner, keyed by the host key so that tokens can't be guessed from
+// it by those who may list services.
+func OwnerLabel(owner string) (string, error) {
+	digest, err := ownerDigest(owner)
+	if err != nil {
+		return "", err
+	}
+	return OwnerLabelPrefix + digest, nil
+}
+
+// ownerDigest returns the HMAC of a token or owner key by which services are
+// labelled, short enough to be a label name or value
+func ownerDigest(owner string) (string, error) {
+	key, err := hostKey()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(owner))
+	return hex.EncodeToString(mac.Sum(nil)[:24]), nil
+}
+
+// ParseOwnerKey decodes a base64url encoded Ed25519 public key
+func ParseOwnerKey(key string) (ed25519.PublicKey, error) {
+	publicKey, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key must be %d bytes", ed25519.PublicKeySize)
+	}
+	return publicKey, nil
+}
+
+// OwnerKeys returns the service's owner public keys
+func (in *Service) OwnerKeys() []string {
+	keys, ok := in.Annotations[OwnerKeysAnnotation]
+	if !ok || keys == "" {
+		return nil
+	}
+	return strings.Split(keys, ",")
+}
+
+// HasOwnerKey reports whether requests signed with the key may manage the
+// service
+func (in *Service) HasOwnerKey(key string) bool {
+	for _, ownerKey := range in.OwnerKeys() {
+		if ownerKey == key {
+			return true
+		}
+	}
+	return false
+}
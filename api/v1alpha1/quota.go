@@ -0,0 +1,188 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AccountLabel identifies the account which paid for the service, the token
+// or owner key from whose balance SERVICE_PRICE was spent. Quotas are
+// enforced per account, so that each service counts towards the quota of a
+// balance which paid for it, however many tokens or owner keys manage it.
+const AccountLabel = "codius.org/account"
+
+// AccountLabelValue returns the value of the account label of services paid
+// for from the account's balance
+func AccountLabelValue(account string) (string, error) {
+	return ownerDigest(account)
+}
+
+// quota limits the services and resources of each owner. Zero values are
+// unlimited.
+type quota struct {
+	services   int
+	containers int
+	cpu        *resource.Quantity
+	memory     *resource.Quantity
+}
+
+// hostQuota returns the quota configured by QUOTA_MAX_SERVICES,
+// QUOTA_MAX_CONTAINERS, QUOTA_MAX_CPU and QUOTA_MAX_MEMORY
+func hostQuota() (quota, error) {
+	var q quota
+	var err error
+	if value := os.Getenv("QUOTA_MAX_SERVICES"); value != "" {
+		if q.services, err = strconv.Atoi(value); err != nil {
+			return q, fmt.Errorf("invalid QUOTA_MAX_SERVICES: %w", err)
+		}
+	}
+	if value := os.Getenv("QUOTA_MAX_CONTAINERS"); value != "" {
+		if q.containers, err = strconv.Atoi(value); err != nil {
+			return q, fmt.Errorf("invalid QUOTA_MAX_CONTAINERS: %w", err)
+		}
+	}
+	if value := os.Getenv("QUOTA_MAX_CPU"); value != "" {
+		cpu, err := resource.ParseQuantity(value)
+		if err != nil {
+			return q, fmt.Errorf("invalid QUOTA_MAX_CPU: %w", err)
+		}
+		q.cpu = &cpu
+	}
+	if value := os.Getenv("QUOTA_MAX_MEMORY"); value != "" {
+		memory, err := resource.ParseQuantity(value)
+		if err != nil {
+			return q, fmt.Errorf("invalid QUOTA_MAX_MEMORY: %w", err)
+		}
+		q.memory = &memory
+	}
+	return q, nil
+}
+
+// usage is the services and resources counted towards an owner's quota
+type usage struct {
+	services   int
+	containers int
+	cpu        resource.Quantity
+	memory     resource.Quantity
+}
+
+func (u *usage) add(codiusService *Service) {
+	u.services++
+	u.containers += len(codiusService.Spec.Containers)
+	for _, container := range codiusService.Spec.Containers {
+		if cpu, ok := container.limit(corev1.ResourceCPU); ok {
+			u.cpu.Add(cpu)
+		}
+		if memory, ok := container.limit(corev1.ResourceMemory); ok {
+			u.memory.Add(memory)
+		}
+	}
+}
+
+// limit returns the container's limit of the resource, if it sets one
+func (container *Container) limit(name corev1.ResourceName) (resource.Quantity, bool) {
+	if container.Resources == nil {
+		return resource.Quantity{}, false
+	}
+	quantity, ok := container.Resources.Limits[name]
+	return quantity, ok
+}
+
+func (q quota) unlimited() bool {
+	return q.services == 0 && q.containers == 0 && q.cpu == nil && q.memory == nil
+}
+
+// validateQuota ensures that the account which paid for the service wouldn't
+// exceed the quota. Services are counted by account from the cache, so
+// concurrent requests may each be admitted before the cache observes the
+// others, exceeding the quota by up to the number of concurrent requests.
+func (r *Service) validateQuota(q quota) error {
+	account, ok := r.Labels[AccountLabel]
+	if c == nil || q.unlimited() || !ok {
+		return nil
+	}
+	var paid ServiceList
+	if err := c.List(context.Background(), &paid, client.MatchingLabels{AccountLabel: account}); err != nil {
+		return errors.NewInternalError(err)
+	}
+	var u usage
+	u.add(r)
+	for i := range paid.Items {
+		if paid.Items[i].Name != r.Name {
+			u.add(&paid.Items[i])
+		}
+	}
+	if err := u.exceeds(q); err != "" {
+		return errors.NewForbidden(schema.GroupResource{Group: "core.codius.org", Resource: "services"}, r.Name,
+			fmt.Errorf("account quota exceeded: %s", err))
+	}
+	return nil
+}
+
+// validateAccount ensures a new mutable service records the account which
+// paid for it, so that it can't be created without counting towards a quota
+func (r *Service) validateAccount(q quota) field.ErrorList {
+	if q.unlimited() || r.Labels["codius.org/immutable"] == "true" {
+		return nil
+	}
+	if _, ok := r.Labels[AccountLabel]; !ok {
+		return field.ErrorList{field.Required(field.NewPath("metadata").Child("labels").Key(AccountLabel), "required by the host's quotas")}
+	}
+	return nil
+}
+
+// validateQuotaResources ensures containers set the resource limits counted
+// towards quotas, so that they can't be exceeded by omitting them
+func (r *Service) validateQuotaResources(q quota) field.ErrorList {
+	var errs field.ErrorList
+	for i, container := range r.Spec.Containers {
+		path := field.NewPath("spec").Child("containers").Index(i).Child("resources").Child("limits")
+		if _, ok := container.limit(corev1.ResourceCPU); q.cpu != nil && !ok {
+			errs = append(errs, field.Required(path.Key(string(corev1.ResourceCPU)), "required by the host's CPU quota"))
+		}
+		if _, ok := container.limit(corev1.ResourceMemory); q.memory != nil && !ok {
+			errs = append(errs, field.Required(path.Key(string(corev1.ResourceMemory)), "required by the host's memory quota"))
+		}
+	}
+	return errs
+}
+
+// exceeds describes how the usage exceeds the quota, if it does
+func (u *usage) exceeds(q quota) string {
+	switch {
+	case q.services > 0 && u.services > q.services:
+		return fmt.Sprintf("%d services exceeds the maximum of %d", u.services, q.services)
+	case q.containers > 0 && u.containers > q.containers:
+		return fmt.Sprintf("%d containers exceeds the maximum of %d", u.containers, q.containers)
+	case q.cpu != nil && u.cpu.Cmp(*q.cpu) > 0:
+		return fmt.Sprintf("%s CPU exceeds the maximum of %s", u.cpu.String(), q.cpu.String())
+	case q.memory != nil && u.memory.Cmp(*q.memory) > 0:
+		return fmt.Sprintf("%s memory exceeds the maximum of %s", u.memory.String(), q.memory.String())
+	}
+	return ""
+}
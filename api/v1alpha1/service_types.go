@@ -17,6 +17,9 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"strings"
+	"time"
+
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -106,6 +109,11 @@ type Container struct {
 	// More info: https://kubernetes.io/docs/concepts/workloads/pods/pod-lifecycle#container-probes
 	// +optional
 	ReadinessProbe *corev1.Probe `json:"readinessProbe,omitempty"`
+	// Compute resources required by the container.
+	// Counted towards the owner's CPU and memory quotas by their limits.
+	// More info: https://kubernetes.io/docs/concepts/configuration/manage-compute-resources-container/
+	// +optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
 	// StartupProbe indicates that the Pod has successfully initialized.
 	// If specified, no other probes are executed until this completes successfully.
 	// If this probe fails, the Pod will be restarted, just as if the livenessProbe failed.
@@ -118,6 +126,36 @@ type Container struct {
 	StartupProbe *corev1.Probe `json:"startupProbe,omitempty"`
 }
 
+// PortProtocol is the application protocol spoken on a service port.
+type PortProtocol string
+
+const (
+	PortProtocolHTTP      PortProtocol = "http"
+	PortProtocolWebSocket PortProtocol = "websocket"
+	PortProtocolGRPC      PortProtocol = "grpc"
+)
+
+type ServicePort struct {
+	// Name of the port specified as an IANA_SVC_NAME.
+	// Each port in a service must have a unique name.
+	// "http" is reserved for the default port.
+	Name string `json:"name"`
+	// Number of the port to route requests to on the pod's IP address.
+	// Each port in a service must have a unique number.
+	Port int32 `json:"port"`
+	// Protocol spoken on the port.
+	// Defaults to "http".
+	// +kubebuilder:validation:Enum=http;websocket;grpc
+	// +kubebuilder:default:=http
+	// +optional
+	Protocol PortProtocol `json:"protocol,omitempty"`
+	// Path prefix of requests to route to this port, e.g. "/ws" or
+	// "/helloworld.Greeter", matching the path itself and paths beneath it.
+	// Request paths are not rewritten.
+	// Requests not matching any port's prefix are routed to the default port.
+	PathPrefix string `json:"pathPrefix"`
+}
+
 // ServiceSpec defines the desired state of Service
 type ServiceSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
@@ -134,6 +172,11 @@ type ServiceSpec struct {
 	// +kubebuilder:default:=80
 	// +optional
 	Port int32 `json:"port,omitempty"`
+
+	// Additional ports exposed by the service, routed by request path prefix.
+	// The default port is always exposed as "http".
+	// +optional
+	Ports []ServicePort `json:"ports,omitempty"`
 }
 
 // ServiceStatus defines the observed state of Service
@@ -156,6 +199,129 @@ type ServiceStatus struct {
 	// either be pods that are running but not yet available or pods that still have not been created.
 	// +optional
 	UnavailableReplicas int32 `json:"unavailableReplicas,omitempty"`
+
+	// Verification state of the service's custom domains.
+	// +optional
+	Domains []DomainStatus `json:"domains,omitempty"`
+
+	// Resources consumed by the service, as accounted by the proxy.
+	// +optional
+	Usage *ServiceUsage `json:"usage,omitempty"`
+
+	// Amount remaining in the service's balance, as last polled from the
+	// payment backend. Denominated in the host's asset (code and scale).
+	// +optional
+	Balance *int64 `json:"balance,omitempty"`
+
+	// Time up to which always-on hosting has been charged. Empty while the
+	// service isn't always on or scaled up.
+	// +optional
+	HostingChargedTime *metav1.Time `json:"hostingChargedTime,omitempty"`
+
+	// Whether the service is suspended because its balance is exhausted.
+	// Suspended services are scaled down and serve the 402 page until their
+	// balance is topped up.
+	// +optional
+	Suspended bool `json:"suspended,omitempty"`
+
+	// Current state of the service.
+	// +optional
+	Conditions []ServiceCondition `json:"conditions,omitempty"`
+}
+
+type ServiceConditionType string
+
+const (
+	// ServiceLowBalance is true when the service's balance is below
+	// LOW_BALANCE_THRESHOLD, which defaults to REQUEST_PRICE.
+	ServiceLowBalance ServiceConditionType = "LowBalance"
+	// ServiceHostingCharged is false when charging an always-on service for
+	// hosting failed, in which case it is no longer kept scaled up until its
+	// balance is topped up.
+	ServiceHostingCharged ServiceConditionType = "HostingCharged"
+)
+
+type ServiceCondition struct {
+	// Type of the condition.
+	Type ServiceConditionType `json:"type"`
+	// Status of the condition, one of True, False or Unknown.
+	Status corev1.ConditionStatus `json:"status"`
+	// Last time the condition transitioned from one status to another.
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// Machine-readable reason for the condition's last transition.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// Human-readable message indicating details about the last transition.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// GetCondition returns the condition of the given type, or nil if unset
+func (in *ServiceStatus) GetCondition(conditionType ServiceConditionType) *ServiceCondition {
+	for i := range in.Conditions {
+		if in.Conditions[i].Type == conditionType {
+			return &in.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// SetCondition adds or updates the condition, keeping its last transition
+// time unless its status changed
+func (in *ServiceStatus) SetCondition(condition ServiceCondition) {
+	existing := in.GetCondition(condition.Type)
+	if existing == nil {
+		if condition.LastTransitionTime.IsZero() {
+			condition.LastTransitionTime = metav1.Now()
+		}
+		in.Conditions = append(in.Conditions, condition)
+		return
+	}
+	if existing.Status != condition.Status {
+		existing.Status = condition.Status
+		existing.LastTransitionTime = metav1.Now()
+	}
+	existing.Reason = condition.Reason
+	existing.Message = condition.Message
+}
+
+type ServiceUsage struct {
+	// Total number of requests served.
+	Requests int64 `json:"requests"`
+	// Total number of request body bytes received.
+	BytesIn int64 `json:"bytesIn"`
+	// Total number of response bytes sent.
+	BytesOut int64 `json:"bytesOut"`
+	// Total amount charged for requests and connections. Denominated in the
+	// host's asset (code and scale).
+	Billed int64 `json:"billed"`
+	// Time at which the usage was last updated.
+	// +optional
+	UpdateTime *metav1.Time `json:"updateTime,omitempty"`
+}
+
+type DomainStatus struct {
+	// Custom domain name.
+	Name string `json:"name"`
+	// Token to publish in a "_codius-challenge.<name>" DNS TXT record in
+	// order to verify ownership of the domain.
+	Token string `json:"token"`
+	// Whether ownership of the domain has been verified.
+	// Requests for verified domains are routed to this service.
+	// +optional
+	Verified bool `json:"verified,omitempty"`
+	// Time at which ownership of the domain was verified. If several
+	// services verify the domain, the earliest keeps it.
+	// +optional
+	VerifiedTime *metav1.Time `json:"verifiedTime,omitempty"`
+	// Time at which the verification record was last found. Verified domains
+	// are rechecked periodically, and unverified once the record is removed.
+	// +optional
+	CheckedTime *metav1.Time `json:"checkedTime,omitempty"`
+	// Human-readable reason the domain isn't verified.
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -174,9 +340,22 @@ type Service struct {
 	// +optional
 	SecretData map[string]string `json:"secretData,omitempty"`
 
+	// Custom domains from which to serve the service once their ownership
+	// has been verified. Each must be a DNS subdomain outside the host's domain.
+	// +optional
+	Domains []string `json:"domains,omitempty"`
+
+	// Keep the service scaled up without requests, charging its balance
+	// REPLICA_MINUTE_PRICE per replica-minute.
+	// +optional
+	AlwaysOn bool `json:"alwaysOn,omitempty"`
+
 	Status ServiceStatus `json:"status,omitempty"`
 }
 
+// VerifiedDomainIndex is the field index of Services by verified custom domain
+const VerifiedDomainIndex = "status.domains.verified"
+
 // +kubebuilder:object:root=true
 
 // ServiceList contains a list of Service
@@ -191,7 +370,8 @@ func init() {
 }
 
 func (in *Service) Sanitize() *Service {
-	// Exclude secretData and internal fields
+	// Exclude secretData and internal fields. Usage and balance are only
+	// served to the service's owners by their own endpoints.
 	return &Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: in.Name,
@@ -206,8 +386,15 @@ func (in *Service) Sanitize() *Service {
 				"codius.org/immutable": in.Labels["codius.org/immutable"],
 			},
 		},
-		Spec:   in.Spec,
-		Status: in.Status,
+		Spec:     in.Spec,
+		Domains:  in.Domains,
+		AlwaysOn: in.AlwaysOn,
+		Status: ServiceStatus{
+			AvailableReplicas:   in.Status.AvailableReplicas,
+			UnavailableReplicas: in.Status.UnavailableReplicas,
+			Domains:             in.Status.Domains,
+			Suspended:           in.Status.Suspended,
+		},
 	}
 }
 
@@ -223,3 +410,64 @@ func (in *Service) Immutify() *Service {
 		SecretData: in.SecretData,
 	}
 }
+
+// PortForPath returns the port to which requests for the given path should be
+// routed, or nil for the default port. The longest matching prefix wins.
+func (in *ServiceSpec) PortForPath(path string) *ServicePort {
+	var match *ServicePort
+	for i, port := range in.Ports {
+		if matchesPathPrefix(path, port.PathPrefix) && (match == nil || len(port.PathPrefix) > len(match.PathPrefix)) {
+			match = &in.Ports[i]
+		}
+	}
+	return match
+}
+
+// matchesPathPrefix reports whether the path is the prefix or is beneath it,
+// so that "/ws" matches "/ws" and "/ws/chat" but not "/wsfoo"
+func matchesPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// VerifiedDomains returns the custom domains whose ownership has been verified
+func (in *Service) VerifiedDomains() []string {
+	var domains []string
+	for _, domain := range in.Status.Domains {
+		if domain.Verified {
+			domains = append(domains, domain.Name)
+		}
+	}
+	return domains
+}
+
+// DomainPrecedes reports whether the service's verification of the domain
+// takes precedence over the other service's. The earliest verification
+// precedes, with ties broken by name, so that a domain verified by several
+// services concurrently is only served by one of them.
+func (in *Service) DomainPrecedes(other *Service, domain string) bool {
+	verified, ok := in.domainVerifiedTime(domain)
+	if !ok {
+		return false
+	}
+	otherVerified, ok := other.domainVerifiedTime(domain)
+	if !ok || verified.Before(otherVerified) {
+		return true
+	}
+	return verified.Equal(otherVerified) && in.Name < other.Name
+}
+
+// domainVerifiedTime returns when the service verified the domain, if it has
+func (in *Service) domainVerifiedTime(domain string) (time.Time, bool) {
+	for _, status := range in.Status.Domains {
+		if status.Name == domain && status.Verified {
+			if status.VerifiedTime == nil {
+				return time.Time{}, true
+			}
+			return status.VerifiedTime.Time, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -17,22 +17,30 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"context"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base32"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 	"regexp"
 	"strings"
 
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/validation/field"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
 var c client.Client
@@ -44,6 +52,9 @@ var validHash = regexp.MustCompile(`^[a-z2-8]{52}$`)
 
 func (r *Service) SetupWebhookWithManager(mgr ctrl.Manager) error {
 	c = mgr.GetClient()
+	// Registered before the builder so that it isn't replaced by the default
+	// validating webhook
+	mgr.GetWebhookServer().Register("/validate-core-codius-org-v1alpha1-service", &webhook.Admission{Handler: &serviceValidator{}})
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(r).
 		Complete()
@@ -60,24 +71,31 @@ func (r *Service) Default() {
 	servicelog.Info("default", "service", r)
 	servicelog.Info("default", "name", r.Name)
 
+	// Default a copy, so that the service is left as it was if hashing fails.
+	// The validating webhook then rejects it with the error.
+	defaulted := r.DeepCopy()
 	if r.SecretData != nil {
 		secretHash, err := r.hashSecret()
 		if err != nil {
+			servicelog.Error(err, "unable to hash secretData", "name", r.Name)
 			return
 		}
-		for _, container := range r.Spec.Containers {
-			for _, env := range container.Env {
-				if env.ValueFrom != nil {
-					env.ValueFrom.SecretKeyRef.Hash = secretHash
+		containers := defaulted.Spec.Containers
+		for i := range containers {
+			for j := range containers[i].Env {
+				if valueFrom := containers[i].Env[j].ValueFrom; valueFrom != nil {
+					valueFrom.SecretKeyRef.Hash = secretHash
 				}
 			}
 		}
 	}
 
-	hash, err := r.hashSpec()
+	hash, err := defaulted.hashSpec()
 	if err != nil {
+		servicelog.Error(err, "unable to hash spec", "name", r.Name)
 		return
 	}
+	r.Spec = defaulted.Spec
 
 	if r.Annotations == nil {
 		r.Annotations = map[string]string{}
@@ -104,16 +122,27 @@ var _ webhook.Validator = &Service{}
 func (r *Service) ValidateCreate() error {
 	servicelog.Info("validate create", "name", r.Name)
 
-	return r.ValidateService()
+	var errs field.ErrorList
+	if _, ok := r.Labels[legacyTokenLabel]; ok {
+		errs = append(errs, field.Forbidden(field.NewPath("metadata").Child("labels").Key(legacyTokenLabel), "tokens must be stored hashed in the "+TokenHashAnnotation+" annotation"))
+	}
+	q, err := hostQuota()
+	if err != nil {
+		return errors.NewInternalError(err)
+	}
+	// Only new services must record their account, so that services created
+	// before quotas were configured can still be updated
+	errs = append(errs, r.validateAccount(q)...)
+
+	return r.validateService(q, errs)
 }
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
 func (r *Service) ValidateUpdate(old runtime.Object) error {
 	servicelog.Info("validate update", "name", r.Name)
 
-	if r.Labels["codius.org/token"] != old.(*Service).Labels["codius.org/token"] {
-		return errors.NewForbidden(schema.GroupResource{Group: "core.codius.org", Resource: r.Kind}, r.Name,
-			field.Invalid(field.NewPath("metadata").Child("labels").Child("codius.org/token"), r.Labels["codius.org/token"], "codius.org/token label must match existing resource"))
+	if err := r.ValidateToken(old.(*Service)); err != nil {
+		return err
 	}
 
 	return r.ValidateService()
@@ -127,85 +156,314 @@ func (r *Service) ValidateDelete() error {
 	return nil
 }
 
+// serviceValidator validates Services like the default validating webhook, but
+// responds with the status of validation errors, rather than only their
+// message, so that the field causes reach API clients
+type serviceValidator struct {
+	decoder *admission.Decoder
+}
+
+var _ admission.DecoderInjector = &serviceValidator{}
+
+// InjectDecoder implements admission.DecoderInjector
+func (v *serviceValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// Handle implements admission.Handler
+func (v *serviceValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	var obj Service
+	var err error
+	switch req.Operation {
+	case admissionv1beta1.Create:
+		if err := v.decoder.DecodeRaw(req.Object, &obj); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		err = obj.ValidateCreate()
+	case admissionv1beta1.Update:
+		var old Service
+		if err := v.decoder.DecodeRaw(req.Object, &obj); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if err := v.decoder.DecodeRaw(req.OldObject, &old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		err = obj.ValidateUpdate(&old)
+	case admissionv1beta1.Delete:
+		if err := v.decoder.DecodeRaw(req.OldObject, &obj); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		err = obj.ValidateDelete()
+	}
+	if err == nil {
+		return admission.Allowed("")
+	}
+	if status, ok := err.(errors.APIStatus); ok {
+		result := status.Status()
+		return admission.Response{
+			AdmissionResponse: admissionv1beta1.AdmissionResponse{
+				Allowed: false,
+				Result:  &result,
+			},
+		}
+	}
+	return admission.Denied(err.Error())
+}
+
+// ValidateToken ensures the token hash is unchanged, unless the Services API
+// rotated it from the existing hash. Services storing their token in the legacy label
+// may only drop the label in favour of a hash of the same token.
+func (r *Service) ValidateToken(old *Service) error {
+	oldHash, ok := old.Annotations[TokenHashAnnotation]
+	if !ok {
+		legacy, hadLegacy := old.Labels[legacyTokenLabel]
+		if newLegacy, ok := r.Labels[legacyTokenLabel]; ok && (!hadLegacy || subtle.ConstantTimeCompare([]byte(newLegacy), []byte(legacy)) != 1) {
+			return errors.NewForbidden(schema.GroupResource{Group: "core.codius.org", Resource: r.Kind}, r.Name,
+				field.Forbidden(field.NewPath("metadata").Child("labels").Key(legacyTokenLabel), legacyTokenLabel+" label must match existing resource"))
+		}
+		newHash, ok := r.Annotations[TokenHashAnnotation]
+		if !ok || (hadLegacy && VerifyToken(newHash, legacy)) || r.tokenRotated("") {
+			return nil
+		}
+		return errors.NewForbidden(schema.GroupResource{Group: "core.codius.org", Resource: r.Kind}, r.Name,
+			field.Forbidden(field.NewPath("metadata").Child("annotations").Key(TokenHashAnnotation), TokenHashAnnotation+" annotation must hash the existing token"))
+	}
+	newHash := r.Annotations[TokenHashAnnotation]
+	if subtle.ConstantTimeCompare([]byte(newHash), []byte(oldHash)) == 1 {
+		return nil
+	}
+	if r.tokenRotated(oldHash) {
+		return nil
+	}
+	return errors.NewForbidden(schema.GroupResource{Group: "core.codius.org", Resource: r.Kind}, r.Name,
+		field.Forbidden(field.NewPath("metadata").Child("annotations").Key(TokenHashAnnotation), TokenHashAnnotation+" annotation must match existing resource"))
+}
+
+// ValidateService validates the whole service, responding with every invalid
+// field at once, so that they can all be fixed in a single round trip
 func (r *Service) ValidateService() error {
-	if err := r.ValidateHash(); err != nil {
-		return err
+	q, err := hostQuota()
+	if err != nil {
+		return errors.NewInternalError(err)
 	}
-	if err := r.ValidateName(); err != nil {
-		return err
+	return r.validateService(q, nil)
+}
+
+// validateService validates the service like ValidateService, aggregating
+// its errors with those already found
+func (r *Service) validateService(q quota, errs field.ErrorList) error {
+	errs = append(errs, r.ValidateHash()...)
+	errs = append(errs, r.ValidateName()...)
+	errs = append(errs, r.ValidateSecretData()...)
+	errs = append(errs, r.ValidatePorts()...)
+	errs = append(errs, r.ValidateContainers()...)
+	errs = append(errs, r.ValidateDomains()...)
+	errs = append(errs, r.ValidateOwnerKeys()...)
+	if r.AlwaysOn && r.Labels["codius.org/immutable"] == "true" {
+		errs = append(errs, field.Forbidden(field.NewPath("alwaysOn"), "immutable services cannot be always on"))
 	}
-	if err := r.ValidateSecretData(); err != nil {
-		return err
+	errs = append(errs, r.validateQuotaResources(q)...)
+	if len(errs) > 0 {
+		return errors.NewInvalid(schema.GroupKind{Group: "core.codius.org", Kind: r.Kind}, r.Name, errs)
+	}
+	return r.validateQuota(q)
+}
+
+func (r *Service) ValidateDomains() field.ErrorList {
+	var errs field.ErrorList
+	hostname := os.Getenv("CODIUS_HOSTNAME")
+	domains := map[string]bool{}
+	for i, domain := range r.Domains {
+		path := field.NewPath("domains").Index(i)
+		if r.Labels["codius.org/immutable"] == "true" {
+			errs = append(errs, field.Forbidden(path, "immutable services cannot have custom domains"))
+			continue
+		}
+		if msgs := validation.IsDNS1123Subdomain(domain); len(msgs) > 0 {
+			errs = append(errs, field.Invalid(path, domain, strings.Join(msgs, "; ")))
+		} else if domain == hostname || strings.HasSuffix(domain, "."+hostname) {
+			errs = append(errs, field.Invalid(path, domain, "custom domain must not be within the host's domain"))
+		}
+		if domains[domain] {
+			errs = append(errs, field.Duplicate(path, domain))
+		}
+		domains[domain] = true
+	}
+	return errs
+}
+
+func (r *Service) ValidateOwnerKeys() field.ErrorList {
+	var errs field.ErrorList
+	path := field.NewPath("metadata").Child("annotations").Key(OwnerKeysAnnotation)
+	keys := map[string]bool{}
+	for _, key := range r.OwnerKeys() {
+		if _, err := ParseOwnerKey(key); err != nil {
+			errs = append(errs, field.Invalid(path, key, "owner key must be a base64url encoded Ed25519 public key: "+err.Error()))
+		}
+		if keys[key] {
+			errs = append(errs, field.Duplicate(path, key))
+		}
+		keys[key] = true
+	}
+	return errs
+}
+
+func (r *Service) ValidatePorts() field.ErrorList {
+	var errs field.ErrorList
+	if r.Spec.Port != 0 {
+		if msgs := validation.IsValidPortNum(int(r.Spec.Port)); len(msgs) > 0 {
+			errs = append(errs, field.Invalid(field.NewPath("spec").Child("port"), r.Spec.Port, strings.Join(msgs, "; ")))
+		}
+	}
+	names := map[string]bool{"http": true}
+	ports := map[int32]bool{r.Spec.Port: true}
+	// The default port is exposed on port 80 of the generated Kubernetes Service
+	if r.Spec.Port != 80 {
+		ports[80] = true
+	}
+	prefixes := map[string]bool{}
+	for i, port := range r.Spec.Ports {
+		path := field.NewPath("spec").Child("ports").Index(i)
+		if msgs := validation.IsValidPortName(port.Name); len(msgs) > 0 {
+			errs = append(errs, field.Invalid(path.Child("name"), port.Name, strings.Join(msgs, "; ")))
+		} else if names[port.Name] {
+			errs = append(errs, field.Duplicate(path.Child("name"), port.Name))
+		}
+		names[port.Name] = true
+		if msgs := validation.IsValidPortNum(int(port.Port)); len(msgs) > 0 {
+			errs = append(errs, field.Invalid(path.Child("port"), port.Port, strings.Join(msgs, "; ")))
+		} else if ports[port.Port] {
+			errs = append(errs, field.Duplicate(path.Child("port"), port.Port))
+		}
+		ports[port.Port] = true
+		if !strings.HasPrefix(port.PathPrefix, "/") {
+			errs = append(errs, field.Invalid(path.Child("pathPrefix"), port.PathPrefix, "path prefix must begin with '/'"))
+		} else if prefixes[port.PathPrefix] {
+			errs = append(errs, field.Duplicate(path.Child("pathPrefix"), port.PathPrefix))
+		}
+		prefixes[port.PathPrefix] = true
+	}
+	return errs
+}
+
+func (r *Service) ValidateContainers() field.ErrorList {
+	var errs field.ErrorList
+	path := field.NewPath("spec").Child("containers")
+	if len(r.Spec.Containers) == 0 {
+		return append(errs, field.Required(path, "must have at least one container"))
+	}
+	ports := map[int]bool{int(r.Spec.Port): true}
+	if r.Spec.Port == 0 {
+		ports[80] = true
+	}
+	for _, port := range r.Spec.Ports {
+		ports[int(port.Port)] = true
+	}
+	names := map[string]bool{}
+	for i, container := range r.Spec.Containers {
+		path := path.Index(i)
+		if msgs := validation.IsDNS1123Label(container.Name); len(msgs) > 0 {
+			errs = append(errs, field.Invalid(path.Child("name"), container.Name, strings.Join(msgs, "; ")))
+		} else if names[container.Name] {
+			errs = append(errs, field.Duplicate(path.Child("name"), container.Name))
+		}
+		names[container.Name] = true
+		if strings.TrimSpace(container.Image) == "" {
+			errs = append(errs, field.Required(path.Child("image"), ""))
+		}
+		for j, env := range container.Env {
+			if msgs := validation.IsCIdentifier(env.Name); len(msgs) > 0 {
+				errs = append(errs, field.Invalid(path.Child("env").Index(j).Child("name"), env.Name, strings.Join(msgs, "; ")))
+			}
+		}
+		errs = append(errs, validateProbePort(path.Child("livenessProbe"), container.LivenessProbe, ports)...)
+		errs = append(errs, validateProbePort(path.Child("readinessProbe"), container.ReadinessProbe, ports)...)
+		errs = append(errs, validateProbePort(path.Child("startupProbe"), container.StartupProbe, ports)...)
+	}
+	return errs
+}
+
+// validateProbePort ensures the probe checks one of the service's ports.
+// Containers don't declare named ports, so probe ports must be numbers.
+func validateProbePort(path *field.Path, probe *corev1.Probe, ports map[int]bool) field.ErrorList {
+	if probe == nil {
+		return nil
+	}
+	var port intstr.IntOrString
+	switch {
+	case probe.HTTPGet != nil:
+		path = path.Child("httpGet").Child("port")
+		port = probe.HTTPGet.Port
+	case probe.TCPSocket != nil:
+		path = path.Child("tcpSocket").Child("port")
+		port = probe.TCPSocket.Port
+	default:
+		return nil
+	}
+	if port.Type != intstr.Int {
+		return field.ErrorList{field.Invalid(path, port.String(), "probe port must be a number")}
+	}
+	if !ports[port.IntValue()] {
+		return field.ErrorList{field.Invalid(path, port.IntValue(), "probe port must be the service's port or one of its ports")}
 	}
 	return nil
 }
 
-func (r *Service) ValidateSecretData() error {
+func (r *Service) ValidateSecretData() field.ErrorList {
+	var errs field.ErrorList
 	var secretHash string
 	if r.SecretData != nil {
 		var err error
 		secretHash, err = r.hashSecret()
 		if err != nil {
-			return errors.NewInvalid(schema.GroupKind{Group: "core.codius.org", Kind: r.Kind}, r.Name, field.ErrorList{
-				field.Invalid(field.NewPath("secretData"), r.SecretData, "unable to hash secretData"),
-			})
+			return append(errs, field.Invalid(field.NewPath("secretData"), r.SecretData, "unable to hash secretData"))
 		}
 	}
 	for i, container := range r.Spec.Containers {
 		for j, env := range container.Env {
 			if env.ValueFrom != nil {
+				path := field.NewPath("spec").Child("containers").Index(i).Child("env").Index(j)
 				if env.Value != "" {
-					return errors.NewInvalid(schema.GroupKind{Group: "core.codius.org", Kind: r.Kind}, r.Name, field.ErrorList{
-						field.Invalid(field.NewPath("spec").Child("containers").Index(i).Child("env").Index(j), env, "env value and valueFrom are mutually exclusive"),
-					})
+					errs = append(errs, field.Invalid(path, env, "env value and valueFrom are mutually exclusive"))
 				}
 				if _, ok := r.SecretData[env.ValueFrom.SecretKeyRef.Key]; !ok {
-					return errors.NewInvalid(schema.GroupKind{Group: "core.codius.org", Kind: r.Kind}, r.Name, field.ErrorList{
-						field.Invalid(field.NewPath("spec").Child("containers").Index(i).Child("env").Index(j).Child("valueFrom").Child("secretKeyRef").Child("key"), env.ValueFrom.SecretKeyRef.Key, "missing env secret data"),
-					})
+					errs = append(errs, field.Invalid(path.Child("valueFrom").Child("secretKeyRef").Child("key"), env.ValueFrom.SecretKeyRef.Key, "missing env secret data"))
 				} else if env.ValueFrom.SecretKeyRef.Hash != secretHash {
-					return errors.NewInvalid(schema.GroupKind{Group: "core.codius.org", Kind: r.Kind}, r.Name, field.ErrorList{
-						field.Invalid(field.NewPath("spec").Child("containers").Index(i).Child("env").Index(j).Child("valueFrom").Child("secretKeyRef").Child("hash"), env.ValueFrom.SecretKeyRef.Hash, "invalid env secret hash"),
-					})
+					errs = append(errs, field.Invalid(path.Child("valueFrom").Child("secretKeyRef").Child("hash"), env.ValueFrom.SecretKeyRef.Hash, "invalid env secret hash"))
 				}
 			}
 		}
 	}
 
-	return nil
+	return errs
 }
 
-func (r *Service) ValidateHash() error {
+func (r *Service) ValidateHash() field.ErrorList {
+	var errs field.ErrorList
 	hash, err := r.hashSpec()
 	if err != nil {
-		return err
+		return append(errs, field.InternalError(field.NewPath("spec"), err))
 	}
 	if r.Annotations["codius.org/hash"] != hash {
-		return errors.NewInvalid(schema.GroupKind{Group: "core.codius.org", Kind: r.Kind}, r.Name, field.ErrorList{
-			field.Invalid(field.NewPath("metadata").Child("annotations").Child("codius.org/hash"), r.Annotations["codius.org/hash"], "codius.org/hash annotation must be sha256 of spec"),
-		})
+		errs = append(errs, field.Invalid(field.NewPath("metadata").Child("annotations").Child("codius.org/hash"), r.Annotations["codius.org/hash"], "codius.org/hash annotation must be sha256 of spec"))
 	}
 	if r.Labels["codius.org/service"] != "svc-"+hash {
-		return errors.NewInvalid(schema.GroupKind{Group: "core.codius.org", Kind: r.Kind}, r.Name, field.ErrorList{
-			field.Invalid(field.NewPath("metadata").Child("labels").Child("codius.org/service"), r.Labels["codius.org/service"], "codius.org/service label must have sha256 of spec"),
-		})
+		errs = append(errs, field.Invalid(field.NewPath("metadata").Child("labels").Child("codius.org/service"), r.Labels["codius.org/service"], "codius.org/service label must have sha256 of spec"))
 	}
-	return nil
+	return errs
 }
 
-func (r *Service) ValidateName() error {
+func (r *Service) ValidateName() field.ErrorList {
+	var errs field.ErrorList
 	if r.Labels["codius.org/immutable"] == "true" {
 		if r.Annotations["codius.org/hash"] != r.Name {
-			return errors.NewInvalid(schema.GroupKind{Group: "core.codius.org", Kind: r.Kind}, r.Name, field.ErrorList{
-				field.Invalid(field.NewPath("metadata").Child("name"), r.Name, "name must be sha256 of spec"),
-			})
+			errs = append(errs, field.Invalid(field.NewPath("metadata").Child("name"), r.Name, "name must be sha256 of spec"))
 		}
 	} else if validHash.MatchString(r.Name) {
-		return errors.NewInvalid(schema.GroupKind{Group: "core.codius.org", Kind: r.Kind}, r.Name, field.ErrorList{
-			field.Invalid(field.NewPath("metadata").Child("name"), r.Name, "name must NOT be a sha256 hash"),
-		})
+		errs = append(errs, field.Invalid(field.NewPath("metadata").Child("name"), r.Name, "name must NOT be a sha256 hash"))
 	}
-	return nil
+	return errs
 }
 
 func (r *Service) hashSpec() (string, error) {
@@ -0,0 +1,477 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newService(name string) *Service {
+	return &Service{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: GroupVersion.String(),
+			Kind:       "Service",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"codius.org/immutable": "false"},
+		},
+		Spec: ServiceSpec{
+			Containers: []Container{{
+				Name:  "app",
+				Image: "hello-world",
+			}},
+			Port: 80,
+		},
+	}
+}
+
+func httpProbe(port int) *corev1.Probe {
+	return &corev1.Probe{Handler: corev1.Handler{HTTPGet: &corev1.HTTPGetAction{Port: intstr.FromInt(port)}}}
+}
+
+// invalidFields returns the paths of the fields for which the error is invalid
+func invalidFields(err error) []string {
+	status, ok := err.(errors.APIStatus)
+	ExpectWithOffset(1, ok).To(BeTrue(), "expected an API status error, got %v", err)
+	ExpectWithOffset(1, errors.IsInvalid(err)).To(BeTrue(), "expected an invalid error, got %v", err)
+	var fields []string
+	for _, cause := range status.Status().Details.Causes {
+		fields = append(fields, cause.Field)
+	}
+	return fields
+}
+
+var _ = Describe("Service webhook", func() {
+	BeforeEach(func() {
+		os.Setenv("CODIUS_HOSTNAME", "codius.example.com")
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("CODIUS_HOSTNAME")
+	})
+
+	Describe("Default", func() {
+		It("sets the hash and hostname", func() {
+			service := newService("my-service")
+			service.Default()
+			hash, err := service.hashSpec()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(service.Annotations).To(HaveKeyWithValue("codius.org/hash", hash))
+			Expect(service.Annotations).To(HaveKeyWithValue("codius.org/hostname", "my-service.codius.example.com"))
+			Expect(service.Labels).To(HaveKeyWithValue("codius.org/service", "svc-"+hash))
+		})
+
+		It("sets the secret hash of every env var from secret data", func() {
+			service := newService("my-service")
+			service.SecretData = map[string]string{"key": "secret"}
+			service.Spec.Containers = append(service.Spec.Containers, Container{Name: "sidecar", Image: "sidecar"})
+			for i := range service.Spec.Containers {
+				service.Spec.Containers[i].Env = []EnvVar{
+					{Name: "PLAIN", Value: "value"},
+					{Name: "SECRET", ValueFrom: &EnvVarSource{SecretKeyRef: SecretKeySelector{Key: "key"}}},
+				}
+			}
+			service.Default()
+			secretHash, err := service.hashSecret()
+			Expect(err).NotTo(HaveOccurred())
+			for _, container := range service.Spec.Containers {
+				Expect(container.Env[0].ValueFrom).To(BeNil())
+				Expect(container.Env[1].ValueFrom.SecretKeyRef.Hash).To(Equal(secretHash))
+			}
+			Expect(service.ValidateService()).To(Succeed())
+		})
+
+		It("hashes specs of containers without resources as before they could be set", func() {
+			data, err := json.Marshal(newService("my-service").Spec)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal(`{"containers":[{"name":"app","image":"hello-world"}],"port":80}`))
+		})
+
+		It("hashes the defaulted spec", func() {
+			service := newService("my-service")
+			service.SecretData = map[string]string{"key": "secret"}
+			service.Spec.Containers[0].Env = []EnvVar{
+				{Name: "SECRET", ValueFrom: &EnvVarSource{SecretKeyRef: SecretKeySelector{Key: "key"}}},
+			}
+			service.Default()
+			hash, err := service.hashSpec()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(service.Annotations["codius.org/hash"]).To(Equal(hash))
+		})
+	})
+
+	table.DescribeTable("validating defaulted services",
+		func(mutate func(*Service), fields ...string) {
+			service := newService("my-service")
+			mutate(service)
+			service.Default()
+			if service.Labels["codius.org/immutable"] == "true" {
+				service.Name = service.Annotations["codius.org/hash"]
+			}
+			err := service.ValidateService()
+			if len(fields) == 0 {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(invalidFields(err)).To(ConsistOf(fields))
+			}
+		},
+		table.Entry("a minimal service", func(*Service) {}),
+		table.Entry("an immutable service", func(service *Service) {
+			service.Labels["codius.org/immutable"] = "true"
+		}),
+		table.Entry("a service with secret env vars", func(service *Service) {
+			service.SecretData = map[string]string{"key": "secret"}
+			service.Spec.Containers[0].Env = []EnvVar{
+				{Name: "SECRET", ValueFrom: &EnvVarSource{SecretKeyRef: SecretKeySelector{Key: "key"}}},
+			}
+		}),
+		table.Entry("a service with additional ports and probes", func(service *Service) {
+			service.Spec.Port = 8080
+			service.Spec.Ports = []ServicePort{{Name: "grpc", Port: 9090, Protocol: PortProtocolGRPC, PathPrefix: "/helloworld.Greeter"}}
+			service.Spec.Containers[0].ReadinessProbe = httpProbe(8080)
+			service.Spec.Containers[0].LivenessProbe = &corev1.Probe{Handler: corev1.Handler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(9090)}}}
+			service.Spec.Containers[0].StartupProbe = &corev1.Probe{Handler: corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"true"}}}}
+		}),
+		table.Entry("a service with custom domains and owner keys", func(service *Service) {
+			service.Domains = []string{"example.com", "www.example.com"}
+			service.Annotations = map[string]string{OwnerKeysAnnotation: "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}
+		}),
+		table.Entry("no containers", func(service *Service) {
+			service.Spec.Containers = nil
+		}, "spec.containers"),
+		table.Entry("invalid and duplicate container names", func(service *Service) {
+			service.Spec.Containers = []Container{
+				{Name: "App", Image: "hello-world"},
+				{Name: "sidecar", Image: "sidecar"},
+				{Name: "sidecar", Image: "sidecar"},
+			}
+		}, "spec.containers[0].name", "spec.containers[2].name"),
+		table.Entry("a container without an image", func(service *Service) {
+			service.Spec.Containers[0].Image = ""
+		}, "spec.containers[0].image"),
+		table.Entry("invalid env names", func(service *Service) {
+			service.Spec.Containers[0].Env = []EnvVar{{Name: "1ST"}, {Name: "MY-VAR"}, {Name: "OK"}}
+		}, "spec.containers[0].env[0].name", "spec.containers[0].env[1].name"),
+		table.Entry("an env var with both a value and a secret", func(service *Service) {
+			service.SecretData = map[string]string{"key": "secret"}
+			service.Spec.Containers[0].Env = []EnvVar{
+				{Name: "SECRET", Value: "value", ValueFrom: &EnvVarSource{SecretKeyRef: SecretKeySelector{Key: "key"}}},
+			}
+		}, "spec.containers[0].env[0]"),
+		table.Entry("an env var from missing secret data", func(service *Service) {
+			service.SecretData = map[string]string{"key": "secret"}
+			service.Spec.Containers[0].Env = []EnvVar{
+				{Name: "SECRET", ValueFrom: &EnvVarSource{SecretKeyRef: SecretKeySelector{Key: "missing"}}},
+			}
+		}, "spec.containers[0].env[0].valueFrom.secretKeyRef.key"),
+		table.Entry("a port out of range", func(service *Service) {
+			service.Spec.Port = 70000
+		}, "spec.port"),
+		table.Entry("invalid additional ports", func(service *Service) {
+			service.Spec.Ports = []ServicePort{
+				{Name: "http", Port: 0, PathPrefix: "ws"},
+				{Name: "ws", Port: 8080, PathPrefix: "/ws"},
+				{Name: "ws", Port: 8080, PathPrefix: "/ws"},
+			}
+		},
+			"spec.ports[0].name", "spec.ports[0].port", "spec.ports[0].pathPrefix",
+			"spec.ports[2].name", "spec.ports[2].port", "spec.ports[2].pathPrefix"),
+		table.Entry("probes of undeclared or named ports", func(service *Service) {
+			service.Spec.Containers[0].ReadinessProbe = httpProbe(8080)
+			service.Spec.Containers[0].LivenessProbe = &corev1.Probe{Handler: corev1.Handler{HTTPGet: &corev1.HTTPGetAction{Port: intstr.FromString("http")}}}
+		}, "spec.containers[0].readinessProbe.httpGet.port", "spec.containers[0].livenessProbe.httpGet.port"),
+		table.Entry("invalid, duplicate and host domains", func(service *Service) {
+			service.Domains = []string{"Not A Domain", "example.com", "example.com", "my.codius.example.com"}
+		}, "domains[0]", "domains[2]", "domains[3]"),
+		table.Entry("custom domains of an immutable service", func(service *Service) {
+			service.Labels["codius.org/immutable"] = "true"
+			service.Domains = []string{"example.com"}
+		}, "domains[0]"),
+		table.Entry("an always on immutable service", func(service *Service) {
+			service.Labels["codius.org/immutable"] = "true"
+			service.AlwaysOn = true
+		}, "alwaysOn"),
+		table.Entry("invalid owner keys", func(service *Service) {
+			service.Annotations = map[string]string{OwnerKeysAnnotation: "not-a-key"}
+		}, "metadata.annotations[codius.org/owner-keys]"),
+		table.Entry("a mutable service named by a hash", func(service *Service) {
+			service.Name = "5qbrjmaepsl5kgd6bhqbfmiwilufhfhrp6wp7d7nakd6ud6lvkva"
+		}, "metadata.name"),
+		table.Entry("every problem at once", func(service *Service) {
+			service.Spec.Port = 0
+			service.Spec.Containers = []Container{{Name: "App", Env: []EnvVar{{Name: "1ST"}}}}
+			service.Domains = []string{"example.com", "example.com"}
+		}, "spec.containers[0].name", "spec.containers[0].image", "spec.containers[0].env[0].name", "domains[1]"),
+	)
+
+	It("rejects services whose spec has changed since being defaulted", func() {
+		service := newService("my-service")
+		service.Default()
+		service.Spec.Containers[0].Image = "changed"
+		Expect(invalidFields(service.ValidateService())).To(ConsistOf(
+			"metadata.annotations.codius.org/hash", "metadata.labels.codius.org/service"))
+	})
+
+	Describe("Sanitize", func() {
+		It("excludes secret data and private status", func() {
+			balance := int64(100)
+			service := newService("my-service")
+			service.SecretData = map[string]string{"key": "secret"}
+			service.Status = ServiceStatus{
+				LastRequestTime:    &metav1.Time{},
+				AvailableReplicas:  1,
+				Domains:            []DomainStatus{{Name: "example.com", Verified: true}},
+				Usage:              &ServiceUsage{Requests: 1},
+				Balance:            &balance,
+				HostingChargedTime: &metav1.Time{},
+				Suspended:          true,
+				Conditions:         []ServiceCondition{{Type: ServiceLowBalance, Status: corev1.ConditionTrue}},
+			}
+			sanitized := service.Sanitize()
+			Expect(sanitized.SecretData).To(BeNil())
+			Expect(sanitized.Status).To(Equal(ServiceStatus{
+				AvailableReplicas: 1,
+				Domains:           []DomainStatus{{Name: "example.com", Verified: true}},
+				Suspended:         true,
+			}))
+		})
+	})
+
+	Describe("PortForPath", func() {
+		It("routes paths matching a prefix to its port", func() {
+			spec := ServiceSpec{Ports: []ServicePort{
+				{Name: "ws", Port: 8081, PathPrefix: "/ws"},
+				{Name: "chat", Port: 8082, PathPrefix: "/ws/chat"},
+				{Name: "api", Port: 8083, PathPrefix: "/api/"},
+			}}
+			Expect(spec.PortForPath("/ws").Name).To(Equal("ws"))
+			Expect(spec.PortForPath("/ws/").Name).To(Equal("ws"))
+			Expect(spec.PortForPath("/ws/chat/room").Name).To(Equal("chat"))
+			Expect(spec.PortForPath("/api/v1").Name).To(Equal("api"))
+			Expect(spec.PortForPath("/wsfoo")).To(BeNil())
+			Expect(spec.PortForPath("/ws/chatty").Name).To(Equal("ws"))
+			Expect(spec.PortForPath("/api")).To(BeNil())
+		})
+	})
+
+	Describe("ValidateToken", func() {
+		var old *Service
+
+		BeforeEach(func() {
+			os.Setenv("CODIUS_HOST_KEY", "secret")
+			old = newService("my-service")
+			hash, err := HashToken("token")
+			Expect(err).NotTo(HaveOccurred())
+			old.Annotations = map[string]string{TokenHashAnnotation: hash}
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("CODIUS_HOST_KEY")
+		})
+
+		rotate := func(token string) *Service {
+			service := old.DeepCopy()
+			hash, err := HashToken(token)
+			Expect(err).NotTo(HaveOccurred())
+			if service.Annotations == nil {
+				service.Annotations = map[string]string{}
+			}
+			service.Annotations[TokenHashAnnotation] = hash
+			return service
+		}
+
+		It("allows updates keeping the token hash", func() {
+			Expect(old.DeepCopy().ValidateToken(old)).To(Succeed())
+		})
+
+		It("forbids changes of the token hash", func() {
+			Expect(errors.IsForbidden(rotate("other").ValidateToken(old))).To(BeTrue())
+		})
+
+		It("allows rotations of the token hash by the Services API", func() {
+			service := rotate("other")
+			mac, err := TokenRotationMAC(service.Name, old.Annotations[TokenHashAnnotation], service.Annotations[TokenHashAnnotation])
+			Expect(err).NotTo(HaveOccurred())
+			service.Annotations[TokenRotationAnnotation] = mac
+			Expect(service.ValidateToken(old)).To(Succeed())
+		})
+
+		It("forbids rotations authorized for another hash", func() {
+			rotated := rotate("other")
+			mac, err := TokenRotationMAC(rotated.Name, old.Annotations[TokenHashAnnotation], rotated.Annotations[TokenHashAnnotation])
+			Expect(err).NotTo(HaveOccurred())
+			service := rotate("attacker")
+			service.Annotations[TokenRotationAnnotation] = mac
+			Expect(errors.IsForbidden(service.ValidateToken(old))).To(BeTrue())
+		})
+
+		It("forbids rotations without the host key", func() {
+			os.Unsetenv("CODIUS_HOST_KEY")
+			service := rotate("other")
+			service.Annotations[TokenRotationAnnotation] = ""
+			Expect(errors.IsForbidden(service.ValidateToken(old))).To(BeTrue())
+		})
+
+		Context("of services without a token hash", func() {
+			BeforeEach(func() {
+				old.Annotations = nil
+				old.Labels = map[string]string{legacyTokenLabel: "token"}
+			})
+
+			It("allows the legacy token label to be replaced with its hash", func() {
+				service := rotate("token")
+				delete(service.Labels, legacyTokenLabel)
+				Expect(service.ValidateToken(old)).To(Succeed())
+			})
+
+			It("forbids hashes of other tokens", func() {
+				service := rotate("attacker")
+				delete(service.Labels, legacyTokenLabel)
+				Expect(errors.IsForbidden(service.ValidateToken(old))).To(BeTrue())
+			})
+
+			It("forbids hashes of tokens of services without one", func() {
+				delete(old.Labels, legacyTokenLabel)
+				Expect(errors.IsForbidden(rotate("attacker").ValidateToken(old))).To(BeTrue())
+			})
+
+			It("allows rotations by the Services API", func() {
+				delete(old.Labels, legacyTokenLabel)
+				service := rotate("other")
+				mac, err := TokenRotationMAC(service.Name, "", service.Annotations[TokenHashAnnotation])
+				Expect(err).NotTo(HaveOccurred())
+				service.Annotations[TokenRotationAnnotation] = mac
+				Expect(service.ValidateToken(old)).To(Succeed())
+			})
+		})
+	})
+
+	Describe("quotas", func() {
+		var account string
+
+		BeforeEach(func() {
+			os.Setenv("CODIUS_HOST_KEY", "secret")
+			var err error
+			account, err = AccountLabelValue("token")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		paid := func(name, cpu string) *Service {
+			service := newService(name)
+			service.Labels[AccountLabel] = account
+			service.Spec.Containers[0].Resources = &corev1.ResourceRequirements{Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse(cpu),
+				corev1.ResourceMemory: resource.MustParse("64Mi"),
+			}}
+			service.Default()
+			return service
+		}
+
+		BeforeEach(func() {
+			other := paid("other", "500m")
+			otherAccount, err := AccountLabelValue("other-token")
+			Expect(err).NotTo(HaveOccurred())
+			other.Labels[AccountLabel] = otherAccount
+			c = fake.NewFakeClientWithScheme(testScheme, paid("existing", "500m"), other)
+		})
+
+		AfterEach(func() {
+			c = nil
+			os.Unsetenv("CODIUS_HOST_KEY")
+			for _, env := range []string{"QUOTA_MAX_SERVICES", "QUOTA_MAX_CONTAINERS", "QUOTA_MAX_CPU", "QUOTA_MAX_MEMORY"} {
+				os.Unsetenv(env)
+			}
+		})
+
+		It("allows services within the quota", func() {
+			os.Setenv("QUOTA_MAX_SERVICES", "2")
+			os.Setenv("QUOTA_MAX_CPU", "1")
+			Expect(paid("new", "500m").ValidateCreate()).To(Succeed())
+		})
+
+		It("doesn't count the service being replaced", func() {
+			os.Setenv("QUOTA_MAX_SERVICES", "1")
+			Expect(paid("existing", "500m").ValidateService()).To(Succeed())
+		})
+
+		It("counts services paid for by the account, whichever owners manage them", func() {
+			os.Setenv("QUOTA_MAX_SERVICES", "1")
+			service := paid("new", "500m")
+			ownerLabel, err := OwnerLabel("new-token")
+			Expect(err).NotTo(HaveOccurred())
+			service.Labels[ownerLabel] = "true"
+			Expect(errors.IsForbidden(service.ValidateCreate())).To(BeTrue())
+		})
+
+		It("forbids services exceeding the account's service quota", func() {
+			os.Setenv("QUOTA_MAX_SERVICES", "1")
+			Expect(errors.IsForbidden(paid("new", "500m").ValidateCreate())).To(BeTrue())
+		})
+
+		It("forbids services exceeding the account's container quota", func() {
+			os.Setenv("QUOTA_MAX_CONTAINERS", "1")
+			Expect(errors.IsForbidden(paid("new", "500m").ValidateCreate())).To(BeTrue())
+		})
+
+		It("forbids services exceeding the account's CPU quota", func() {
+			os.Setenv("QUOTA_MAX_CPU", "1")
+			Expect(errors.IsForbidden(paid("new", "600m").ValidateCreate())).To(BeTrue())
+		})
+
+		It("forbids services exceeding the account's memory quota", func() {
+			os.Setenv("QUOTA_MAX_MEMORY", "100Mi")
+			Expect(errors.IsForbidden(paid("new", "500m").ValidateCreate())).To(BeTrue())
+		})
+
+		It("requires new services to record the account which paid for them", func() {
+			os.Setenv("QUOTA_MAX_SERVICES", "1")
+			service := paid("new", "500m")
+			delete(service.Labels, AccountLabel)
+			Expect(invalidFields(service.ValidateCreate())).To(ConsistOf("metadata.labels[codius.org/account]"))
+		})
+
+		It("responds with missing accounts alongside the other invalid fields", func() {
+			os.Setenv("QUOTA_MAX_CPU", "1")
+			service := newService("new")
+			service.Default()
+			Expect(invalidFields(service.ValidateCreate())).To(ConsistOf(
+				"metadata.labels[codius.org/account]", "spec.containers[0].resources.limits[cpu]"))
+		})
+
+		It("requires resource limits counted towards quotas", func() {
+			os.Setenv("QUOTA_MAX_CPU", "1")
+			os.Setenv("QUOTA_MAX_MEMORY", "1Gi")
+			service := newService("new")
+			service.Labels[AccountLabel] = account
+			service.Default()
+			Expect(invalidFields(service.ValidateService())).To(ConsistOf(
+				"spec.containers[0].resources.limits[cpu]", "spec.containers[0].resources.limits[memory]"))
+		})
+	})
+})
@@ -0,0 +1,112 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+)
+
+const (
+	// TokenHashAnnotation holds the salted hash of the bearer token with
+	// which the service is managed
+	TokenHashAnnotation = "codius.org/token-hash"
+	// TokenRotationAnnotation authorizes the latest change of a service's
+	// token hash, with a MAC of the previous and new hashes by the host key.
+	// Only the Services API has the key, so tokens are only rotated by it.
+	TokenRotationAnnotation = "codius.org/token-rotation"
+	// legacyTokenLabel held the raw bearer token of services created before
+	// tokens were hashed
+	legacyTokenLabel = "codius.org/token"
+)
+
+// HashToken returns the salted hash of the token, in the form
+// "sha256$<salt>$<digest>"
+func HashToken(token string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hashToken(salt, token), nil
+}
+
+func hashToken(salt []byte, token string) string {
+	digest := sha256.Sum256(append(append([]byte{}, salt...), token...))
+	return "sha256$" + base64.RawURLEncoding.EncodeToString(salt) + "$" + base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// VerifyToken reports whether the token matches the salted hash
+func VerifyToken(hash, token string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 3 || parts[0] != "sha256" {
+		return false
+	}
+	salt, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(salt, token)), []byte(hash)) == 1
+}
+
+// HasToken reports whether the service is managed with the token
+func (in *Service) HasToken(token string) bool {
+	if hash, ok := in.Annotations[TokenHashAnnotation]; ok {
+		return VerifyToken(hash, token)
+	}
+	legacy, ok := in.Labels[legacyTokenLabel]
+	return ok && subtle.ConstantTimeCompare([]byte(legacy), []byte(token)) == 1
+}
+
+// hostKey returns the host's secret key, with which the operator
+// authenticates the changes it makes to services and derives owner labels
+func hostKey() ([]byte, error) {
+	key := os.Getenv("CODIUS_HOST_KEY")
+	if key == "" {
+		return nil, errors.New("CODIUS_HOST_KEY is not set")
+	}
+	return []byte(key), nil
+}
+
+// TokenRotationMAC returns the value of the TokenRotationAnnotation
+// authorizing the rotation of the named service's token hash from oldHash to
+// newHash. It can't authorize any other change of the hash, so it needn't be
+// removed once the token has been rotated.
+func TokenRotationMAC(name, oldHash, newHash string) (string, error) {
+	key, err := hostKey()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name + "\n" + oldHash + "\n" + newHash))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// tokenRotated reports whether the service's token hash was rotated from
+// oldHash by the Services API
+func (in *Service) tokenRotated(oldHash string) bool {
+	expected, err := TokenRotationMAC(in.Name, oldHash, in.Annotations[TokenHashAnnotation])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(in.Annotations[TokenRotationAnnotation]), []byte(expected))
+}
@@ -0,0 +1,284 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package apiclient is a client of the Codius Services API, as described by
+// its OpenAPI document at /openapi.json.
+package apiclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codius/codius-operator/api/v1alpha1"
+	"github.com/codius/codius-operator/servicesapi"
+	"github.com/google/uuid"
+)
+
+// Client manages services through the Services API, authenticating requests
+// with either a bearer token or signatures by an owner key
+type Client struct {
+	// URL of the Services API
+	URL string
+	// Token authenticates requests as a bearer token
+	Token string
+	// PrivateKey signs requests instead of the token, if set
+	PrivateKey ed25519.PrivateKey
+	// HTTPClient defaults to a client with a 30 second timeout
+	HTTPClient *http.Client
+}
+
+// defaultHTTPClient times out requests which the Services API doesn't
+// answer, allowing for it to retry the receipt verifier
+var defaultHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// OwnerKey returns the base64url encoded public key of the client's private
+// key, to list in a service's owner keys
+func (c *Client) OwnerKey() string {
+	return base64.RawURLEncoding.EncodeToString(c.PrivateKey.Public().(ed25519.PublicKey))
+}
+
+// ListOptions filter and paginate lists of services
+type ListOptions struct {
+	LabelSelector string
+	Limit         int64
+	Continue      string
+}
+
+// Precondition makes creating or replacing a service conditional on its
+// current state. Unmet preconditions fail with a 412 *servicesapi.Error.
+type Precondition func(*http.Request)
+
+// IfMatch replaces the service only if its ETag is etag, or if it exists for
+// "*"
+func IfMatch(etag string) Precondition {
+	return func(req *http.Request) {
+		req.Header.Set("If-Match", etag)
+	}
+}
+
+// IfNotExists creates the service only if it doesn't exist
+func IfNotExists() Precondition {
+	return func(req *http.Request) {
+		req.Header.Set("If-None-Match", "*")
+	}
+}
+
+// CreateOrReplaceService creates or replaces the service, returning the
+// service and whether it was created
+func (c *Client) CreateOrReplaceService(ctx context.Context, name string, service *servicesapi.Service, preconditions ...Precondition) (*v1alpha1.Service, bool, error) {
+	body, err := json.Marshal(service)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := c.do(ctx, "PUT", "/services/"+url.PathEscape(name), body, true, preconditions...)
+	if err != nil {
+		return nil, false, err
+	}
+	var codiusService v1alpha1.Service
+	return &codiusService, resp.StatusCode == http.StatusCreated, c.decode(resp, &codiusService)
+}
+
+// GetService returns the service
+func (c *Client) GetService(ctx context.Context, name string) (*v1alpha1.Service, error) {
+	service, _, err := c.GetServiceETag(ctx, name)
+	return service, err
+}
+
+// GetServiceETag returns the service and its ETag, with which to replace it
+// only if it hasn't since been modified
+func (c *Client) GetServiceETag(ctx context.Context, name string) (*v1alpha1.Service, string, error) {
+	resp, err := c.do(ctx, "GET", "/services/"+url.PathEscape(name), nil, false)
+	if err != nil {
+		return nil, "", err
+	}
+	var service v1alpha1.Service
+	return &service, resp.Header.Get("ETag"), c.decode(resp, &service)
+}
+
+// ListServices returns a page of the services the client manages
+func (c *Client) ListServices(ctx context.Context, opts ListOptions) (*servicesapi.ServiceList, error) {
+	query := url.Values{}
+	if opts.LabelSelector != "" {
+		query.Set("labelSelector", opts.LabelSelector)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.FormatInt(opts.Limit, 10))
+	}
+	if opts.Continue != "" {
+		query.Set("continue", opts.Continue)
+	}
+	path := "/services"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	resp, err := c.do(ctx, "GET", path, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	var list servicesapi.ServiceList
+	return &list, c.decode(resp, &list)
+}
+
+// DeleteService deletes the service
+func (c *Client) DeleteService(ctx context.Context, name string) error {
+	resp, err := c.do(ctx, "DELETE", "/services/"+url.PathEscape(name), nil, true)
+	if err != nil {
+		return err
+	}
+	return c.decode(resp, nil)
+}
+
+// GetServiceUsage returns the usage of the service
+func (c *Client) GetServiceUsage(ctx context.Context, name string) (*v1alpha1.ServiceUsage, error) {
+	resp, err := c.do(ctx, "GET", "/services/"+url.PathEscape(name)+"/usage", nil, true)
+	if err != nil {
+		return nil, err
+	}
+	var usage v1alpha1.ServiceUsage
+	return &usage, c.decode(resp, &usage)
+}
+
+// RotateServiceToken replaces the service's token. Subsequent requests by a
+// client authenticating with a token must use the new token.
+func (c *Client) RotateServiceToken(ctx context.Context, name, token string) error {
+	body, err := json.Marshal(servicesapi.TokenRotation{Token: token})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, "PUT", "/services/"+url.PathEscape(name)+"/token", body, true)
+	if err != nil {
+		return err
+	}
+	return c.decode(resp, nil)
+}
+
+// GetServiceBalance returns the amount remaining in the service's balance
+func (c *Client) GetServiceBalance(ctx context.Context, name string) (int64, error) {
+	resp, err := c.do(ctx, "GET", "/services/"+url.PathEscape(name)+"/balance", nil, true)
+	if err != nil {
+		return 0, err
+	}
+	var balance servicesapi.Balance
+	return balance.Balance, c.decode(resp, &balance)
+}
+
+// TopUpServiceBalance credits the base64 encoded STREAM receipt to the
+// service's balance, returning the new balance
+func (c *Client) TopUpServiceBalance(ctx context.Context, name, receipt string) (int64, error) {
+	resp, err := c.do(ctx, "POST", "/services/"+url.PathEscape(name)+"/balance", []byte(receipt), false)
+	if err != nil {
+		return 0, err
+	}
+	var balance servicesapi.Balance
+	return balance.Balance, c.decode(resp, &balance)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body []byte, authenticate bool, preconditions ...Precondition) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.URL, "/")+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		if method == "POST" {
+			req.Header.Set("Content-Type", "text/plain")
+		} else {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	}
+	for _, precondition := range preconditions {
+		precondition(req)
+	}
+	if authenticate {
+		if c.PrivateKey != nil {
+			c.sign(req, body)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = defaultHTTPClient
+	}
+	return httpClient.Do(req)
+}
+
+// sign adds a Signature header to the request, signed by the private key.
+// The signature covers a unique X-Request-Id, as the Services API accepts
+// each signature only once.
+func (c *Client) sign(req *http.Request, body []byte) {
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Request-Id", uuid.New().String())
+	headers := []string{"(request-target)", "host", "date", "x-request-id"}
+	if len(body) > 0 {
+		digest := sha256.Sum256(body)
+		req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+		headers = append(headers, "digest")
+	}
+	lines := []string{
+		"(request-target): " + strings.ToLower(req.Method) + " " + req.URL.RequestURI(),
+		"host: " + req.URL.Host,
+		"date: " + req.Header.Get("Date"),
+		"x-request-id: " + req.Header.Get("X-Request-Id"),
+	}
+	if len(body) > 0 {
+		lines = append(lines, "digest: "+req.Header.Get("Digest"))
+	}
+	signature := ed25519.Sign(c.PrivateKey, []byte(strings.Join(lines, "\n")))
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="ed25519",headers="%s",signature="%s"`,
+		c.OwnerKey(), strings.Join(headers, " "), base64.StdEncoding.EncodeToString(signature)))
+}
+
+// decode decodes a successful response into v, or returns the response's
+// *servicesapi.Error
+func (c *Client) decode(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		apiErr := &servicesapi.Error{}
+		if err := json.Unmarshal(data, apiErr); err != nil || apiErr.Code == 0 {
+			return &servicesapi.Error{
+				Code:    resp.StatusCode,
+				Reason:  strings.Replace(http.StatusText(resp.StatusCode), " ", "", -1),
+				Message: strings.TrimSpace(string(data)),
+			}
+		}
+		return apiErr
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
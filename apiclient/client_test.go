@@ -0,0 +1,403 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiclient
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/codius/codius-operator/api/v1alpha1"
+	"github.com/codius/codius-operator/servers"
+	"github.com/codius/codius-operator/servicesapi"
+)
+
+// applyClient applies server-side apply patches, which the fake client
+// doesn't support, by creating or updating the service
+type applyClient struct {
+	client.Client
+	// applyErr, if set, fails applies which aren't dry runs
+	applyErr *error
+}
+
+func (c applyClient) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() != types.ApplyPatchType {
+		return c.Client.Patch(ctx, obj, patch, opts...)
+	}
+	patchOptions := &client.PatchOptions{}
+	patchOptions.ApplyOptions(opts)
+	if len(patchOptions.DryRun) > 0 {
+		return nil
+	}
+	if c.applyErr != nil && *c.applyErr != nil {
+		return *c.applyErr
+	}
+	service := obj.(*v1alpha1.Service)
+	var existing v1alpha1.Service
+	if err := c.Get(ctx, types.NamespacedName{Name: service.Name}, &existing); apierrors.IsNotFound(err) {
+		return c.Create(ctx, service)
+	} else if err != nil {
+		return err
+	}
+	if service.ResourceVersion != "" && service.ResourceVersion != existing.ResourceVersion {
+		return apierrors.NewConflict(v1alpha1.GroupVersion.WithResource("services").GroupResource(), service.Name, errors.New("the object has been modified"))
+	}
+	service.ResourceVersion = existing.ResourceVersion
+	service.Status = existing.Status
+	return c.Update(ctx, service)
+}
+
+var _ = Describe("Client", func() {
+	var (
+		ctx       = context.Background()
+		verifier  *httptest.Server
+		refunds   int
+		applyErr  error
+		api       *httptest.Server
+		k8sClient client.Client
+		// routes are the methods and path templates of the requests to api
+		routes map[string]bool
+	)
+
+	BeforeEach(func() {
+		// The receipt verifier has a balance of 100 for every account, and
+		// credits receipts with 50
+		refunds = http.StatusOK
+		applyErr = nil
+		verifier = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			switch {
+			case strings.HasSuffix(req.URL.Path, ":refund"):
+				rw.WriteHeader(refunds)
+			case strings.HasSuffix(req.URL.Path, ":creditReceipt"):
+				rw.Write([]byte("150"))
+			case req.Method == "GET":
+				rw.Write([]byte("100"))
+			}
+		}))
+		os.Setenv("RECEIPT_VERIFIER_URL", verifier.URL)
+		os.Setenv("SERVICE_PRICE", "10")
+		os.Setenv("CODIUS_HOST_KEY", "secret")
+		os.Setenv("SERVICES_API_RATE_LIMIT", "0")
+		os.Setenv("SERVICES_API_OWNER_RATE_LIMIT", "0")
+	})
+
+	JustBeforeEach(func() {
+		k8sClient = applyClient{fake.NewFakeClientWithScheme(scheme), &applyErr}
+		services := &servers.ServicesApi{
+			Client: k8sClient,
+			Log:    logf.Log.WithName("servers").WithName("Services API"),
+		}
+		handler := services.Handler()
+		routes = map[string]bool{}
+		api = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			segments := strings.Split(req.URL.Path, "/")
+			if len(segments) > 2 && segments[1] == "services" {
+				segments[2] = "{name}"
+			}
+			routes[strings.ToLower(req.Method)+" "+strings.Join(segments, "/")] = true
+			handler.ServeHTTP(rw, req)
+		}))
+	})
+
+	AfterEach(func() {
+		api.Close()
+		verifier.Close()
+	})
+
+	newService := func(ownerKeys ...string) *servicesapi.Service {
+		return &servicesapi.Service{
+			Spec: v1alpha1.ServiceSpec{
+				Containers: []v1alpha1.Container{{Name: "app", Image: "hello"}},
+				Port:       8080,
+			},
+			OwnerKeys: ownerKeys,
+		}
+	}
+
+	expectError := func(err error, code int) {
+		ExpectWithOffset(1, err).To(HaveOccurred())
+		apiErr, ok := err.(*servicesapi.Error)
+		ExpectWithOffset(1, ok).To(BeTrue(), err.Error())
+		ExpectWithOffset(1, apiErr.Code).To(Equal(code))
+		ExpectWithOffset(1, apiErr.Reason).To(Equal(strings.Replace(http.StatusText(code), " ", "", -1)))
+	}
+
+	It("should serve an OpenAPI document describing each route", func() {
+		resp, err := http.Get(api.URL + "/openapi.json")
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		var document struct {
+			OpenAPI    string
+			Paths      map[string]map[string]interface{}
+			Components struct {
+				Schemas map[string]interface{}
+			}
+		}
+		Expect(json.NewDecoder(resp.Body).Decode(&document)).To(Succeed())
+		Expect(document.OpenAPI).To(HavePrefix("3."))
+		Expect(document.Paths).To(HaveLen(5))
+		Expect(document.Paths["/services"]).To(HaveKey("get"))
+		Expect(document.Paths["/services/{name}"]).To(SatisfyAll(HaveKey("get"), HaveKey("put"), HaveKey("delete")))
+		Expect(document.Paths["/services/{name}/usage"]).To(HaveKey("get"))
+		Expect(document.Paths["/services/{name}/token"]).To(HaveKey("put"))
+		Expect(document.Paths["/services/{name}/balance"]).To(SatisfyAll(HaveKey("get"), HaveKey("post")))
+		Expect(document.Components.Schemas).To(SatisfyAll(
+			HaveKey("servicesapi.Service"),
+			HaveKey("servicesapi.Error"),
+			HaveKey("v1alpha1.Service"),
+			HaveKey("v1alpha1.ServiceSpec"),
+		))
+	})
+
+	It("should request only the routes described by the OpenAPI document", func() {
+		owner := &Client{URL: api.URL, Token: "secret"}
+		_, _, err := owner.CreateOrReplaceService(ctx, "hello", newService())
+		Expect(err).NotTo(HaveOccurred())
+		_, err = owner.GetService(ctx, "hello")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = owner.ListServices(ctx, ListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = owner.GetServiceUsage(ctx, "hello")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = owner.GetServiceBalance(ctx, "hello")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = owner.TopUpServiceBalance(ctx, "hello", "receipt")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(owner.RotateServiceToken(ctx, "hello", "rotated")).To(Succeed())
+		owner.Token = "rotated"
+		Expect(owner.DeleteService(ctx, "hello")).To(Succeed())
+		requested := map[string]bool{}
+		for route := range routes {
+			requested[route] = true
+		}
+
+		resp, err := http.Get(api.URL + "/openapi.json")
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		var document struct {
+			Paths map[string]map[string]interface{}
+		}
+		Expect(json.NewDecoder(resp.Body).Decode(&document)).To(Succeed())
+		documented := map[string]bool{}
+		for path, operations := range document.Paths {
+			for method := range operations {
+				documented[method+" "+path] = true
+			}
+		}
+		// The client requests every route, and no others
+		Expect(requested).To(Equal(documented))
+	})
+
+	It("should manage a service with a token", func() {
+		owner := &Client{URL: api.URL, Token: "secret"}
+		service, created, err := owner.CreateOrReplaceService(ctx, "hello", newService())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(created).To(BeTrue())
+		Expect(service.Name).To(Equal("hello"))
+		Expect(service.Spec.Port).To(Equal(int32(8080)))
+		_, created, err = owner.CreateOrReplaceService(ctx, "hello", newService())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(created).To(BeFalse())
+
+		service, err = owner.GetService(ctx, "hello")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Spec.Port).To(Equal(int32(8080)))
+		Expect(service.Annotations).NotTo(HaveKey(v1alpha1.TokenHashAnnotation))
+
+		_, _, err = (&Client{URL: api.URL, Token: "other"}).CreateOrReplaceService(ctx, "hello", newService())
+		expectError(err, http.StatusForbidden)
+
+		usage, err := owner.GetServiceUsage(ctx, "hello")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(usage.Requests).To(BeZero())
+		balance, err := owner.GetServiceBalance(ctx, "hello")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(balance).To(Equal(int64(100)))
+		balance, err = (&Client{URL: api.URL}).TopUpServiceBalance(ctx, "hello", "receipt")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(balance).To(Equal(int64(150)))
+
+		Expect(owner.RotateServiceToken(ctx, "hello", "rotated")).To(Succeed())
+		_, err = owner.GetServiceUsage(ctx, "hello")
+		expectError(err, http.StatusForbidden)
+		owner.Token = "rotated"
+
+		Expect(owner.DeleteService(ctx, "hello")).To(Succeed())
+		_, err = owner.GetService(ctx, "hello")
+		expectError(err, http.StatusNotFound)
+		_, created, err = owner.CreateOrReplaceService(ctx, "hello", newService())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(created).To(BeTrue())
+	})
+
+	It("should create and replace a service only if its preconditions are met", func() {
+		owner := &Client{URL: api.URL, Token: "secret"}
+		_, _, err := owner.CreateOrReplaceService(ctx, "hello", newService(), IfMatch("*"))
+		expectError(err, http.StatusPreconditionFailed)
+		_, created, err := owner.CreateOrReplaceService(ctx, "hello", newService(), IfNotExists())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(created).To(BeTrue())
+		_, _, err = owner.CreateOrReplaceService(ctx, "hello", newService(), IfNotExists())
+		expectError(err, http.StatusPreconditionFailed)
+
+		_, etag, err := owner.GetServiceETag(ctx, "hello")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(etag).NotTo(BeEmpty())
+		// Status updates don't modify the service
+		var codiusService v1alpha1.Service
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "hello"}, &codiusService)).To(Succeed())
+		codiusService.Status.Usage = &v1alpha1.ServiceUsage{Requests: 1}
+		Expect(k8sClient.Status().Update(ctx, &codiusService)).To(Succeed())
+		modified := newService()
+		modified.Spec.Port = 8081
+		_, _, err = owner.CreateOrReplaceService(ctx, "hello", modified, IfMatch(etag))
+		Expect(err).NotTo(HaveOccurred())
+		// The service was modified by the previous replacement
+		_, _, err = owner.CreateOrReplaceService(ctx, "hello", newService(), IfMatch(etag))
+		expectError(err, http.StatusPreconditionFailed)
+		_, _, err = owner.CreateOrReplaceService(ctx, "hello", newService(), IfMatch("*"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should record refunds which fail to be reconciled", func() {
+		owner := &Client{URL: api.URL, Token: "secret"}
+		refunds = http.StatusBadRequest
+		applyErr = apierrors.NewInternalError(errors.New("unavailable"))
+		_, _, err := owner.CreateOrReplaceService(ctx, "hello", newService())
+		expectError(err, http.StatusInternalServerError)
+		var secrets corev1.SecretList
+		Expect(k8sClient.List(ctx, &secrets, client.MatchingLabels{"codius.org/refund": "failed"})).To(Succeed())
+		Expect(secrets.Items).To(HaveLen(1))
+		Expect(secrets.Items[0].Annotations).To(HaveKeyWithValue("codius.org/service", "hello"))
+		Expect(secrets.Items[0].Data).To(HaveKeyWithValue("account", []byte("secret")))
+		Expect(secrets.Items[0].Data).To(HaveKeyWithValue("amount", []byte("10")))
+	})
+
+	It("should manage a service with signatures by an owner key", func() {
+		_, privateKey, err := ed25519.GenerateKey(nil)
+		Expect(err).NotTo(HaveOccurred())
+		owner := &Client{URL: api.URL, PrivateKey: privateKey}
+		_, otherKey, err := ed25519.GenerateKey(nil)
+		Expect(err).NotTo(HaveOccurred())
+		other := &Client{URL: api.URL, PrivateKey: otherKey}
+
+		_, _, err = owner.CreateOrReplaceService(ctx, "hello", newService())
+		expectError(err, http.StatusBadRequest)
+		_, created, err := owner.CreateOrReplaceService(ctx, "hello", newService(owner.OwnerKey()))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(created).To(BeTrue())
+
+		_, _, err = other.CreateOrReplaceService(ctx, "hello", newService(other.OwnerKey()))
+		expectError(err, http.StatusForbidden)
+		expectError(other.DeleteService(ctx, "hello"), http.StatusForbidden)
+
+		// Either owner key may manage the service once both are listed
+		_, _, err = owner.CreateOrReplaceService(ctx, "hello", newService(owner.OwnerKey(), other.OwnerKey()))
+		Expect(err).NotTo(HaveOccurred())
+		// Only the holder of the token may rotate it
+		expectError(owner.RotateServiceToken(ctx, "hello", "attacker"), http.StatusForbidden)
+		Expect(other.DeleteService(ctx, "hello")).To(Succeed())
+	})
+
+	It("should reject replayed signed requests", func() {
+		_, privateKey, err := ed25519.GenerateKey(nil)
+		Expect(err).NotTo(HaveOccurred())
+		owner := &Client{URL: api.URL, PrivateKey: privateKey}
+		_, _, err = owner.CreateOrReplaceService(ctx, "hello", newService(owner.OwnerKey()))
+		Expect(err).NotTo(HaveOccurred())
+
+		req, err := http.NewRequest("GET", api.URL+"/services/hello/usage", nil)
+		Expect(err).NotTo(HaveOccurred())
+		owner.sign(req, nil)
+		for _, status := range []int{http.StatusOK, http.StatusUnauthorized} {
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(status))
+		}
+	})
+
+	Context("with an owner rate limit", func() {
+		BeforeEach(func() {
+			os.Setenv("SERVICES_API_OWNER_RATE_LIMIT", "1")
+		})
+
+		It("should reject requests exceeding the rate limit", func() {
+			owner := &Client{URL: api.URL, Token: "secret"}
+			_, _, err := owner.CreateOrReplaceService(ctx, "hello", newService())
+			Expect(err).NotTo(HaveOccurred())
+			_, err = owner.GetServiceUsage(ctx, "hello")
+			expectError(err, http.StatusTooManyRequests)
+
+			// Other owners are limited separately
+			_, _, err = (&Client{URL: api.URL, Token: "other"}).CreateOrReplaceService(ctx, "world", newService())
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should only limit owners by their authenticated requests", func() {
+			_, privateKey, err := ed25519.GenerateKey(nil)
+			Expect(err).NotTo(HaveOccurred())
+			owner := &Client{URL: api.URL, PrivateKey: privateKey}
+			for i := 0; i < 3; i++ {
+				req, err := http.NewRequest("GET", api.URL+"/services", nil)
+				Expect(err).NotTo(HaveOccurred())
+				req.Header.Set("Signature", `keyId="`+owner.OwnerKey()+`",algorithm="ed25519",headers="date",signature="AAAA"`)
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).NotTo(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+			}
+			_, _, err = owner.CreateOrReplaceService(ctx, "hello", newService(owner.OwnerKey()))
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	It("should list the services managed by the client", func() {
+		owner := &Client{URL: api.URL, Token: "secret"}
+		other := &Client{URL: api.URL, Token: "other"}
+		for _, name := range []string{"hello", "world"} {
+			_, _, err := owner.CreateOrReplaceService(ctx, name, newService())
+			Expect(err).NotTo(HaveOccurred())
+		}
+		_, _, err := other.CreateOrReplaceService(ctx, "other", newService())
+		Expect(err).NotTo(HaveOccurred())
+
+		list, err := owner.ListServices(ctx, ListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(list.Items).To(HaveLen(2))
+		_, err = (&Client{URL: api.URL}).ListServices(ctx, ListOptions{})
+		expectError(err, http.StatusUnauthorized)
+
+		_, err = owner.ListServices(ctx, ListOptions{LabelSelector: "!!"})
+		expectError(err, http.StatusBadRequest)
+	})
+})
@@ -0,0 +1,135 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+
+	"golang.org/x/crypto/acme"
+)
+
+// acmeClient orders certificates with the RFC 8555 client of
+// golang.org/x/crypto/acme, solving challenges with our own solvers
+type acmeClient struct {
+	*acme.Client
+}
+
+// register creates the ACME account for the client's key, or looks up the
+// existing account if there is one
+func (c acmeClient) register(ctx context.Context, email string) error {
+	account := &acme.Account{}
+	if email != "" {
+		account.Contact = []string{"mailto:" + email}
+	}
+	if _, err := c.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return err
+	}
+	return nil
+}
+
+// obtain orders a certificate for the domains, solving their authorizations
+// with the given solvers. It returns the PEM encoded certificate chain and
+// private key.
+func (c acmeClient) obtain(ctx context.Context, domains []string, solvers []Solver) ([]byte, []byte, error) {
+	order, err := c.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := c.authorize(ctx, authzURL, solvers); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, _, err := c.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	var chain []byte
+	for _, cert := range der {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chain, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// authorize solves a challenge of the authorization with the first solver
+// supporting one of its challenge types, and waits for it to become valid
+func (c acmeClient) authorize(ctx context.Context, authzURL string, solvers []Solver) error {
+	authz, err := c.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	domain := authz.Identifier.Value
+	var solver Solver
+	var challenge *acme.Challenge
+	for _, s := range solvers {
+		for _, chal := range authz.Challenges {
+			if chal.Type == s.Type() {
+				solver, challenge = s, chal
+				break
+			}
+		}
+		if solver != nil {
+			break
+		}
+	}
+	if solver == nil {
+		return fmt.Errorf("acme: no solver for the challenges offered for %s", domain)
+	}
+
+	// The key authorization is the http-01 challenge response, from which
+	// dns-01 solvers derive their TXT record
+	keyAuth, err := c.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return err
+	}
+	if err := solver.Present(ctx, domain, challenge.Token, keyAuth); err != nil {
+		return err
+	}
+	defer solver.CleanUp(context.Background(), domain, challenge.Token, keyAuth)
+
+	if _, err := c.Accept(ctx, challenge); err != nil {
+		return err
+	}
+	_, err = c.WaitAuthorization(ctx, authz.URI)
+	return err
+}
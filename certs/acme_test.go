@@ -0,0 +1,388 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// testACME is a local stand-in for an ACME server. It verifies request
+// signatures and nonces, validates challenges with the given functions, and
+// issues certificates from a test CA.
+type testACME struct {
+	*httptest.Server
+	// validateHTTP01 returns the http-01 challenge response of the domain
+	validateHTTP01 func(domain, token string) string
+	// validateDNS01 returns the _acme-challenge TXT record of the domain
+	validateDNS01 func(domain string) string
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu       sync.Mutex
+	nonces   map[string]bool
+	accounts map[string]*ecdsa.PublicKey
+	orders   []*testOrder
+	authzs   []*testAuthz
+}
+
+// acmeIdentifier, acmeOrder, acmeAuthorization and acmeChallenge are the
+// RFC 8555 resources served by the test server
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	Status         string           `json:"status"`
+	Identifiers    []acmeIdentifier `json:"identifiers"`
+	Authorizations []string         `json:"authorizations"`
+	Finalize       string           `json:"finalize"`
+	Certificate    string           `json:"certificate,omitempty"`
+}
+
+type acmeAuthorization struct {
+	Status     string          `json:"status"`
+	Identifier acmeIdentifier  `json:"identifier"`
+	Wildcard   bool            `json:"wildcard,omitempty"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeChallenge struct {
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Status string `json:"status"`
+}
+
+type testOrder struct {
+	acmeOrder
+	chain []byte
+}
+
+type testAuthz struct {
+	acmeAuthorization
+	account *ecdsa.PublicKey
+}
+
+func newTestACME() *testACME {
+	s := &testACME{
+		nonces:   map[string]bool{},
+		accounts: map[string]*ecdsa.PublicKey{},
+	}
+	var err error
+	if s.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &s.caKey.PublicKey, s.caKey)
+	if err != nil {
+		panic(err)
+	}
+	if s.caCert, err = x509.ParseCertificate(der); err != nil {
+		panic(err)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// orderCount returns the number of orders placed
+func (s *testACME) orderCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.orders)
+}
+
+func (s *testACME) serveHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rw.Header().Set("Replay-Nonce", s.newNonce())
+
+	switch {
+	case req.URL.Path == "/directory":
+		json.NewEncoder(rw).Encode(map[string]string{
+			"newNonce":   s.URL + "/new-nonce",
+			"newAccount": s.URL + "/new-account",
+			"newOrder":   s.URL + "/new-order",
+		})
+		return
+	case req.URL.Path == "/new-nonce":
+		return
+	case req.Method != "POST":
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	account, payload, err := s.verify(req)
+	if err != nil {
+		problem(rw, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	var id int
+	switch {
+	case req.URL.Path == "/new-account":
+		kid := fmt.Sprintf("%s/account/%d", s.URL, len(s.accounts))
+		for existing, key := range s.accounts {
+			if key.X.Cmp(account.X) == 0 && key.Y.Cmp(account.Y) == 0 {
+				kid = existing
+			}
+		}
+		s.accounts[kid] = account
+		rw.Header().Set("Location", kid)
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write([]byte(`{"status":"valid"}`))
+	case req.URL.Path == "/new-order":
+		var request acmeOrder
+		json.Unmarshal(payload, &request)
+		s.newOrder(rw, account, request.Identifiers)
+	case scan(req.URL.Path, "/order/%d", &id, len(s.orders)):
+		json.NewEncoder(rw).Encode(s.orders[id].acmeOrder)
+	case scan(req.URL.Path, "/authz/%d", &id, len(s.authzs)):
+		json.NewEncoder(rw).Encode(s.authzs[id].acmeAuthorization)
+	case scan(req.URL.Path, "/challenge/%d", &id, len(s.authzs)):
+		s.validate(s.authzs[id])
+		json.NewEncoder(rw).Encode(map[string]string{"status": "processing"})
+	case scan(req.URL.Path, "/finalize/%d", &id, len(s.orders)):
+		var request struct {
+			CSR string `json:"csr"`
+		}
+		json.Unmarshal(payload, &request)
+		if err := s.finalize(id, request.CSR); err != nil {
+			problem(rw, http.StatusForbidden, "badCSR", err.Error())
+			return
+		}
+		json.NewEncoder(rw).Encode(s.orders[id].acmeOrder)
+	case scan(req.URL.Path, "/cert/%d", &id, len(s.orders)):
+		rw.Header().Set("Content-Type", "application/pem-certificate-chain")
+		rw.Write(s.orders[id].chain)
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *testACME) newNonce() string {
+	data := make([]byte, 8)
+	rand.Read(data)
+	nonce := base64.RawURLEncoding.EncodeToString(data)
+	s.nonces[nonce] = true
+	return nonce
+}
+
+// verify checks the JWS signature, nonce and url of the request, returning
+// the account key and payload
+func (s *testACME) verify(req *http.Request) (*ecdsa.PublicKey, []byte, error) {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&jws); err != nil {
+		return nil, nil, err
+	}
+	protectedJSON, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, nil, err
+	}
+	var protected struct {
+		Alg   string `json:"alg"`
+		Nonce string `json:"nonce"`
+		URL   string `json:"url"`
+		Kid   string `json:"kid"`
+		JWK   *struct {
+			X string `json:"x"`
+			Y string `json:"y"`
+		} `json:"jwk"`
+	}
+	if err := json.Unmarshal(protectedJSON, &protected); err != nil {
+		return nil, nil, err
+	}
+	if !s.nonces[protected.Nonce] {
+		return nil, nil, errors.New("bad nonce")
+	}
+	delete(s.nonces, protected.Nonce)
+	if protected.URL != s.URL+req.URL.Path {
+		return nil, nil, errors.New("url mismatch")
+	}
+
+	var key *ecdsa.PublicKey
+	if protected.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(protected.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(protected.JWK.Y)
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	} else if key = s.accounts[protected.Kid]; key == nil {
+		return nil, nil, errors.New("unknown account")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil || len(signature) != 64 {
+		return nil, nil, errors.New("bad signature")
+	}
+	hash := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	r := new(big.Int).SetBytes(signature[:32])
+	sig := new(big.Int).SetBytes(signature[32:])
+	if protected.Alg != "ES256" || !ecdsa.Verify(key, hash[:], r, sig) {
+		return nil, nil, errors.New("bad signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return key, payload, err
+}
+
+func (s *testACME) newOrder(rw http.ResponseWriter, account *ecdsa.PublicKey, identifiers []acmeIdentifier) {
+	id := len(s.orders)
+	order := &testOrder{acmeOrder: acmeOrder{
+		Status:      "pending",
+		Identifiers: identifiers,
+		Finalize:    fmt.Sprintf("%s/finalize/%d", s.URL, id),
+	}}
+	for _, identifier := range identifiers {
+		authzID := len(s.authzs)
+		authz := &testAuthz{account: account}
+		authz.Status = "pending"
+		authz.Identifier = identifier
+		// Wildcard identifiers are authorized for their base domain by dns-01
+		types := []string{"http-01", "dns-01"}
+		if strings.HasPrefix(identifier.Value, "*.") {
+			authz.Identifier.Value = strings.TrimPrefix(identifier.Value, "*.")
+			authz.Wildcard = true
+			types = []string{"dns-01"}
+		}
+		for _, typ := range types {
+			authz.Challenges = append(authz.Challenges, acmeChallenge{
+				Type:   typ,
+				URL:    fmt.Sprintf("%s/challenge/%d", s.URL, authzID),
+				Token:  fmt.Sprintf("token-%d", authzID),
+				Status: "pending",
+			})
+		}
+		s.authzs = append(s.authzs, authz)
+		order.Authorizations = append(order.Authorizations, fmt.Sprintf("%s/authz/%d", s.URL, authzID))
+	}
+	s.orders = append(s.orders, order)
+	rw.Header().Set("Location", fmt.Sprintf("%s/order/%d", s.URL, id))
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(order.acmeOrder)
+}
+
+func (s *testACME) validate(authz *testAuthz) {
+	token := authz.Challenges[0].Token
+	thumbprint, err := acme.JWKThumbprint(authz.account)
+	if err != nil {
+		panic(err)
+	}
+	keyAuth := token + "." + thumbprint
+	domain := authz.Identifier.Value
+	authz.Status = "invalid"
+	for _, chal := range authz.Challenges {
+		switch chal.Type {
+		case "http-01":
+			if s.validateHTTP01 != nil && s.validateHTTP01(domain, token) == keyAuth {
+				authz.Status = "valid"
+			}
+		case "dns-01":
+			if s.validateDNS01 != nil && s.validateDNS01(domain) == dns01Record(keyAuth) {
+				authz.Status = "valid"
+			}
+		}
+	}
+}
+
+func (s *testACME) finalize(id int, csrB64 string) error {
+	order := s.orders[id]
+	for _, authzURL := range order.Authorizations {
+		var authzID int
+		fmt.Sscanf(strings.TrimPrefix(authzURL, s.URL), "/authz/%d", &authzID)
+		if s.authzs[authzID].Status != "valid" {
+			return errors.New("order is not ready")
+		}
+	}
+	der, err := base64.RawURLEncoding.DecodeString(csrB64)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return err
+	}
+	if len(csr.DNSNames) != len(order.Identifiers) {
+		return errors.New("csr names do not match order")
+	}
+	for i, name := range csr.DNSNames {
+		if name != order.Identifiers[i].Value {
+			return errors.New("csr names do not match order")
+		}
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(id + 2)),
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, template, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		return err
+	}
+	order.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...)
+	order.Status = "valid"
+	order.Certificate = fmt.Sprintf("%s/cert/%d", s.URL, id)
+	return nil
+}
+
+func scan(path, format string, id *int, count int) bool {
+	n, err := fmt.Sscanf(path, format, id)
+	return err == nil && n == 1 && *id >= 0 && *id < count
+}
+
+func problem(rw http.ResponseWriter, status int, typ, detail string) {
+	rw.Header().Set("Content-Type", "application/problem+json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(map[string]string{
+		"type":   "urn:ietf:params:acme:error:" + typ,
+		"detail": detail,
+	})
+}
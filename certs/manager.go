@@ -0,0 +1,372 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package certs obtains TLS certificates for service hostnames from an ACME
+// certificate authority, caching them in Kubernetes Secrets.
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/crypto/acme"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	accountSecretName  = "acme-account"
+	accountKeyKey      = "key.pem"
+	defaultRenewBefore = 30 * 24 * time.Hour
+	obtainTimeout      = 2 * time.Minute
+)
+
+// +kubebuilder:rbac:namespace=system,groups=core,resources=secrets,verbs=list;watch;get;create;update;delete
+
+// Manager obtains and renews certificates on demand during TLS handshakes.
+// Subdomains of Hostname share a wildcard certificate if a dns-01 solver is
+// configured, otherwise each host gets its own certificate.
+type Manager struct {
+	client.Client
+	Log logr.Logger
+
+	// ACME directory url, e.g. https://acme-v02.api.letsencrypt.org/directory
+	DirectoryURL string
+	// Contact email for the ACME account
+	Email string
+	// Namespace in which to store certificate and account Secrets
+	Namespace string
+	// Hostname of the Codius host
+	Hostname string
+	// Solvers for ACME challenges, tried in order
+	Solvers []Solver
+	// HostPolicy rejects hosts for which no certificate should be obtained
+	HostPolicy func(ctx context.Context, host string) error
+	// How long before expiry to renew certificates. Defaults to 30 days.
+	RenewBefore time.Duration
+	// HTTP client for the ACME server
+	HTTPClient *http.Client
+
+	mu       sync.Mutex
+	certs    map[string]*tls.Certificate
+	renewing map[string]bool
+	// obtaining is closed once the order in flight for each name completes
+	obtaining map[string]chan struct{}
+
+	// acmeMu guards the registration of the ACME account
+	acmeMu sync.Mutex
+	acme   *acmeClient
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if host == "" {
+		return nil, errors.New("certs: missing server name")
+	}
+	name := m.certName(host)
+	ctx, cancel := context.WithTimeout(context.Background(), obtainTimeout)
+	defer cancel()
+
+	if cert := m.cached(name); cert != nil {
+		return cert, nil
+	}
+	if m.HostPolicy != nil {
+		if err := m.HostPolicy(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+	cert, err := m.load(ctx, name)
+	if err != nil {
+		m.Log.Error(err, "Failed to load certificate", "name", name)
+	}
+	if cert != nil {
+		m.store(name, cert)
+		if m.cached(name) != nil {
+			return cert, nil
+		}
+	}
+	return m.obtain(ctx, name)
+}
+
+// certName returns the name of the certificate serving the host
+func (m *Manager) certName(host string) string {
+	if m.Hostname != "" && m.hasSolver("dns-01") {
+		if parts := strings.SplitN(host, ".", 2); len(parts) == 2 && parts[1] == m.Hostname {
+			return "*." + m.Hostname
+		}
+	}
+	return host
+}
+
+func (m *Manager) hasSolver(typ string) bool {
+	for _, solver := range m.Solvers {
+		if solver.Type() == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// cached returns the certificate from memory, scheduling its renewal if it
+// is close to expiry. It returns nil if there is no unexpired certificate.
+func (m *Manager) cached(name string) *tls.Certificate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cert, ok := m.certs[name]
+	if !ok || time.Now().After(cert.Leaf.NotAfter) {
+		return nil
+	}
+	if time.Until(cert.Leaf.NotAfter) < m.renewBefore() && !m.renewing[name] {
+		if m.renewing == nil {
+			m.renewing = map[string]bool{}
+		}
+		m.renewing[name] = true
+		go m.renew(name)
+	}
+	return cert
+}
+
+func (m *Manager) store(name string, cert *tls.Certificate) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.certs == nil {
+		m.certs = map[string]*tls.Certificate{}
+	}
+	m.certs[name] = cert
+}
+
+func (m *Manager) renew(name string) {
+	defer func() {
+		m.mu.Lock()
+		delete(m.renewing, name)
+		m.mu.Unlock()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), obtainTimeout)
+	defer cancel()
+	if _, err := m.obtain(ctx, name); err != nil {
+		m.Log.Error(err, "Failed to renew certificate", "name", name)
+	}
+}
+
+// obtain orders a certificate from the ACME server and stores it. Only one
+// order is placed at a time for each name, while orders for different names
+// proceed concurrently.
+func (m *Manager) obtain(ctx context.Context, name string) (*tls.Certificate, error) {
+	var done chan struct{}
+	for {
+		m.mu.Lock()
+		// Another handshake may have obtained the certificate while waiting
+		if cert, ok := m.certs[name]; ok && time.Until(cert.Leaf.NotAfter) > m.renewBefore() {
+			m.mu.Unlock()
+			return cert, nil
+		}
+		inFlight, ok := m.obtaining[name]
+		if !ok {
+			if m.obtaining == nil {
+				m.obtaining = map[string]chan struct{}{}
+			}
+			done = make(chan struct{})
+			m.obtaining[name] = done
+			m.mu.Unlock()
+			break
+		}
+		m.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-inFlight:
+		}
+	}
+	defer func() {
+		m.mu.Lock()
+		delete(m.obtaining, name)
+		close(done)
+		m.mu.Unlock()
+	}()
+
+	ca, err := m.initACME(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.Log.Info("Obtaining certificate", "name", name)
+	solvers := m.Solvers
+	if strings.HasPrefix(name, "*.") {
+		// Wildcard identifiers can only be validated by dns-01
+		solvers = nil
+		for _, solver := range m.Solvers {
+			if solver.Type() == "dns-01" {
+				solvers = append(solvers, solver)
+			}
+		}
+	}
+	chain, key, err := ca.obtain(ctx, []string{name}, solvers)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := parseCertificate(chain, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.save(ctx, name, chain, key); err != nil {
+		// The certificate is still usable from memory
+		m.Log.Error(err, "Failed to save certificate", "name", name)
+	}
+	m.store(name, cert)
+	return cert, nil
+}
+
+// initACME registers the ACME account, creating its key if necessary
+func (m *Manager) initACME(ctx context.Context) (*acmeClient, error) {
+	m.acmeMu.Lock()
+	defer m.acmeMu.Unlock()
+	if m.acme != nil {
+		return m.acme, nil
+	}
+	key, err := m.accountKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := m.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	ca := &acmeClient{&acme.Client{
+		Key:          key,
+		DirectoryURL: m.DirectoryURL,
+		HTTPClient:   httpClient,
+	}}
+	if err := ca.register(ctx, m.Email); err != nil {
+		return nil, err
+	}
+	m.acme = ca
+	return ca, nil
+}
+
+func (m *Manager) accountKey(ctx context.Context) (*ecdsa.PrivateKey, error) {
+	var secret corev1.Secret
+	err := m.Get(ctx, types.NamespacedName{Name: accountSecretName, Namespace: m.Namespace}, &secret)
+	if err == nil {
+		block, _ := pem.Decode(secret.Data[accountKeyKey])
+		if block == nil {
+			return nil, errors.New("certs: invalid ACME account key")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	secret = corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      accountSecretName,
+			Namespace: m.Namespace,
+		},
+		Data: map[string][]byte{
+			accountKeyKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+		},
+	}
+	if err := m.Create(ctx, &secret); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// secretName returns the name of the Secret storing the certificate
+func secretName(name string) string {
+	return "tls-" + strings.Replace(name, "*", "wildcard", 1)
+}
+
+// load returns the certificate stored in its Secret, or nil if there is none
+func (m *Manager) load(ctx context.Context, name string) (*tls.Certificate, error) {
+	var secret corev1.Secret
+	if err := m.Get(ctx, types.NamespacedName{Name: secretName(name), Namespace: m.Namespace}, &secret); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	return parseCertificate(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+}
+
+// save stores the certificate in its Secret
+func (m *Manager) save(ctx context.Context, name string, chain, key []byte) error {
+	secret := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName(name),
+			Namespace: m.Namespace,
+			Labels: map[string]string{
+				"codius.org/certificate": "true",
+			},
+			Annotations: map[string]string{
+				"codius.org/certificate-name": name,
+			},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       chain,
+			corev1.TLSPrivateKeyKey: key,
+		},
+	}
+	err := m.Create(ctx, &secret)
+	if apierrors.IsAlreadyExists(err) {
+		var existing corev1.Secret
+		if err := m.Get(ctx, types.NamespacedName{Name: secret.Name, Namespace: m.Namespace}, &existing); err != nil {
+			return err
+		}
+		existing.Type = secret.Type
+		existing.Data = secret.Data
+		return m.Update(ctx, &existing)
+	}
+	return err
+}
+
+func (m *Manager) renewBefore() time.Duration {
+	if m.RenewBefore == 0 {
+		return defaultRenewBefore
+	}
+	return m.RenewBefore
+}
+
+func parseCertificate(chain, key []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(chain, key)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
@@ -0,0 +1,203 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// fakeDNS01Solver records TXT records in memory
+type fakeDNS01Solver struct {
+	mu      sync.Mutex
+	records map[string]string
+}
+
+func (s *fakeDNS01Solver) Type() string {
+	return "dns-01"
+}
+
+func (s *fakeDNS01Solver) Present(ctx context.Context, domain, token, keyAuth string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[domain] = dns01Record(keyAuth)
+	return nil
+}
+
+func (s *fakeDNS01Solver) CleanUp(ctx context.Context, domain, token, keyAuth string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, domain)
+	return nil
+}
+
+func (s *fakeDNS01Solver) lookup(domain string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records[domain]
+}
+
+var _ = Describe("Manager", func() {
+	var (
+		acme      *testACME
+		http01    *HTTP01Solver
+		dns01     *fakeDNS01Solver
+		k8sClient client.Client
+	)
+
+	BeforeEach(func() {
+		acme = newTestACME()
+		k8sClient = fake.NewFakeClientWithScheme(scheme)
+		http01 = &HTTP01Solver{Client: k8sClient, Namespace: "codius"}
+		dns01 = &fakeDNS01Solver{records: map[string]string{}}
+		acme.validateHTTP01 = func(domain, token string) string {
+			rec := httptest.NewRecorder()
+			http01.ServeHTTP(rec, httptest.NewRequest("GET", "http://"+domain+http01Prefix+token, nil))
+			return rec.Body.String()
+		}
+		acme.validateDNS01 = dns01.lookup
+	})
+
+	AfterEach(func() {
+		acme.Close()
+	})
+
+	newManager := func(solvers ...Solver) *Manager {
+		return &Manager{
+			Client:       k8sClient,
+			Log:          logf.Log.WithName("certs"),
+			DirectoryURL: acme.URL + "/directory",
+			Email:        "admin@codius.test",
+			Namespace:    "codius",
+			Hostname:     "codius.test",
+			Solvers:      solvers,
+		}
+	}
+
+	getCertificate := func(manager *Manager, host string) (*tls.Certificate, error) {
+		return manager.GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+	}
+
+	It("should obtain a certificate for a custom domain with http-01", func() {
+		manager := newManager(http01, dns01)
+		cert, err := getCertificate(manager, "example.com")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cert.Leaf.DNSNames).To(Equal([]string{"example.com"}))
+		Expect(acme.orderCount()).To(Equal(1))
+
+		var secret corev1.Secret
+		Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "tls-example.com", Namespace: "codius"}, &secret)).To(Succeed())
+		Expect(secret.Type).To(Equal(corev1.SecretTypeTLS))
+		Expect(secret.Labels).To(HaveKeyWithValue("codius.org/certificate", "true"))
+		Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: accountSecretName, Namespace: "codius"}, &secret)).To(Succeed())
+	})
+
+	It("should obtain a certificate per name for subdomains without dns-01", func() {
+		manager := newManager(http01)
+		cert, err := getCertificate(manager, "hello.codius.test")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cert.Leaf.DNSNames).To(Equal([]string{"hello.codius.test"}))
+	})
+
+	It("should share a wildcard certificate between subdomains with dns-01", func() {
+		manager := newManager(http01, dns01)
+		cert, err := getCertificate(manager, "hello.codius.test")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cert.Leaf.DNSNames).To(Equal([]string{"*.codius.test"}))
+
+		other, err := getCertificate(manager, "world.codius.test")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other).To(BeIdenticalTo(cert))
+		Expect(acme.orderCount()).To(Equal(1))
+
+		var secret corev1.Secret
+		Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "tls-wildcard.codius.test", Namespace: "codius"}, &secret)).To(Succeed())
+	})
+
+	It("should reuse certificates and the account stored in Secrets", func() {
+		_, err := getCertificate(newManager(http01), "example.com")
+		Expect(err).NotTo(HaveOccurred())
+
+		cert, err := getCertificate(newManager(http01), "example.com")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cert.Leaf.DNSNames).To(Equal([]string{"example.com"}))
+		Expect(acme.orderCount()).To(Equal(1))
+
+		_, err = getCertificate(newManager(http01), "example.org")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(acme.accounts).To(HaveLen(1))
+	})
+
+	It("should not obtain certificates for hosts rejected by the host policy", func() {
+		manager := newManager(http01)
+		manager.HostPolicy = func(ctx context.Context, host string) error {
+			return errors.New("no service for host")
+		}
+		_, err := getCertificate(manager, "example.com")
+		Expect(err).To(MatchError("no service for host"))
+		Expect(acme.orderCount()).To(Equal(0))
+	})
+
+	It("should fail if the challenge can't be solved", func() {
+		acme.validateHTTP01 = nil
+		_, err := getCertificate(newManager(http01), "example.com")
+		Expect(err).To(MatchError(ContainSubstring("authorization error for example.com")))
+	})
+
+	It("should serve http-01 key authorizations presented by another replica", func() {
+		replica := &HTTP01Solver{Client: k8sClient, Namespace: "codius"}
+		Expect(http01.Present(context.Background(), "example.com", "token", "token.thumbprint")).To(Succeed())
+
+		rec := httptest.NewRecorder()
+		replica.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com"+http01Prefix+"token", nil))
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.String()).To(Equal("token.thumbprint"))
+
+		Expect(http01.CleanUp(context.Background(), "example.com", "token", "token.thumbprint")).To(Succeed())
+		rec = httptest.NewRecorder()
+		replica.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com"+http01Prefix+"token", nil))
+		Expect(rec.Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("should place one order for concurrent handshakes of the same host", func() {
+		manager := newManager(http01)
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				_, err := getCertificate(manager, "example.com")
+				Expect(err).NotTo(HaveOccurred())
+			}()
+		}
+		wg.Wait()
+		Expect(acme.orderCount()).To(Equal(1))
+	})
+})
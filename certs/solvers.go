@@ -0,0 +1,200 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Solver fulfils ACME challenges of a single type
+type Solver interface {
+	// Type returns the ACME challenge type solved, e.g. "http-01" or "dns-01".
+	Type() string
+	// Present makes the key authorization of the challenge token available
+	// for validation of the domain.
+	Present(ctx context.Context, domain, token, keyAuth string) error
+	// CleanUp removes anything created by Present.
+	CleanUp(ctx context.Context, domain, token, keyAuth string) error
+}
+
+const (
+	http01Prefix      = "/.well-known/acme-challenge/"
+	keyAuthKey        = "keyAuthorization"
+	challengeTokenKey = "token"
+)
+
+// HTTP01Solver solves http-01 challenges by serving key authorizations at
+// /.well-known/acme-challenge/. It must be served on port 80 of every domain.
+// Key authorizations are stored in Secrets, so that every replica of the
+// proxy serves those presented by any of them.
+type HTTP01Solver struct {
+	client.Client
+	// Namespace in which to store key authorization Secrets
+	Namespace string
+}
+
+var _ Solver = &HTTP01Solver{}
+var _ http.Handler = &HTTP01Solver{}
+
+func (s *HTTP01Solver) Type() string {
+	return "http-01"
+}
+
+func (s *HTTP01Solver) Present(ctx context.Context, domain, token, keyAuth string) error {
+	secret := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      challengeSecretName(token),
+			Namespace: s.Namespace,
+			Labels: map[string]string{
+				"codius.org/acme-challenge": "http-01",
+			},
+			Annotations: map[string]string{
+				"codius.org/acme-challenge-domain": domain,
+			},
+		},
+		Data: map[string][]byte{
+			challengeTokenKey: []byte(token),
+			keyAuthKey:        []byte(keyAuth),
+		},
+	}
+	if err := s.Create(ctx, &secret); !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	// Left over from an order whose clean up failed
+	var existing corev1.Secret
+	if err := s.Get(ctx, types.NamespacedName{Name: secret.Name, Namespace: s.Namespace}, &existing); err != nil {
+		return err
+	}
+	existing.Data = secret.Data
+	return s.Update(ctx, &existing)
+}
+
+func (s *HTTP01Solver) CleanUp(ctx context.Context, domain, token, keyAuth string) error {
+	secret := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      challengeSecretName(token),
+			Namespace: s.Namespace,
+		},
+	}
+	return client.IgnoreNotFound(s.Delete(ctx, &secret))
+}
+
+func (s *HTTP01Solver) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	token := strings.TrimPrefix(req.URL.Path, http01Prefix)
+	var secret corev1.Secret
+	err := s.Get(req.Context(), types.NamespacedName{Name: challengeSecretName(token), Namespace: s.Namespace}, &secret)
+	if apierrors.IsNotFound(err) || (err == nil && string(secret.Data[challengeTokenKey]) != token) {
+		http.NotFound(rw, req)
+		return
+	} else if err != nil {
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.Write(secret.Data[keyAuthKey])
+}
+
+// challengeSecretName returns the name of the Secret storing the key
+// authorization of the challenge token, which may contain characters not
+// allowed in names
+func challengeSecretName(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return "acme-http01-" + hex.EncodeToString(hash[:16])
+}
+
+// HookDNS01Solver solves dns-01 challenges by asking an external service to
+// create and remove TXT records. It POSTs {"fqdn": ..., "value": ...} to
+// URL/present and URL/cleanup, compatible with lego's httpreq DNS provider.
+type HookDNS01Solver struct {
+	URL string
+	// Time to wait after presenting for the record to propagate
+	PropagationDelay time.Duration
+	Client           *http.Client
+}
+
+var _ Solver = &HookDNS01Solver{}
+
+func (s *HookDNS01Solver) Type() string {
+	return "dns-01"
+}
+
+func (s *HookDNS01Solver) Present(ctx context.Context, domain, token, keyAuth string) error {
+	if err := s.call(ctx, "present", domain, keyAuth); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(s.PropagationDelay):
+		return nil
+	}
+}
+
+func (s *HookDNS01Solver) CleanUp(ctx context.Context, domain, token, keyAuth string) error {
+	return s.call(ctx, "cleanup", domain, keyAuth)
+}
+
+func (s *HookDNS01Solver) call(ctx context.Context, action, domain, keyAuth string) error {
+	body, err := json.Marshal(map[string]string{
+		"fqdn":  "_acme-challenge." + domain + ".",
+		"value": dns01Record(keyAuth),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(s.URL, "/")+"/"+action, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("dns-01 %s hook failed: %d %s", action, resp.StatusCode, msg)
+	}
+	return nil
+}
+
+// dns01Record returns the value of the TXT record for a dns-01 challenge
+func dns01Record(keyAuth string) string {
+	hash := sha256.Sum256([]byte(keyAuth))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
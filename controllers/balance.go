@@ -0,0 +1,95 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+
+	"github.com/codius/codius-operator/api/v1alpha1"
+	"github.com/codius/codius-operator/payments"
+)
+
+// balancePollInterval is how often always-on services are charged for
+// hosting and their balances are polled
+const balancePollInterval = time.Minute
+
+// reconcileBalance records the Codius Service's balance, whether it is low,
+// and whether the service is suspended for lack of balance
+func (r *ServiceReconciler) reconcileBalance(ctx context.Context, codiusService *v1alpha1.Service) error {
+	log := r.Log.WithValues("service", codiusService.Name)
+
+	status := codiusService.Status.DeepCopy()
+	balance, err := payments.Balance(ctx, codiusService.Name)
+	if err != nil {
+		log.Error(err, "Failed to get balance")
+		status.SetCondition(v1alpha1.ServiceCondition{
+			Type:    v1alpha1.ServiceLowBalance,
+			Status:  corev1.ConditionUnknown,
+			Reason:  "BalanceUnavailable",
+			Message: "Failed to get balance from the payment backend",
+		})
+	} else {
+		status.Balance = &balance
+		// Suspend the service until its balance is topped up, or covers the
+		// hosting it failed to pay for
+		status.Suspended = balance <= 0 || (!hostingCharged(status) && balance < replicaMinutePrice())
+		if status.Suspended != codiusService.Status.Suspended {
+			log.Info("Updating suspension", "suspended", status.Suspended, "balance", balance)
+		}
+		threshold := lowBalanceThreshold()
+		if balance < threshold {
+			status.SetCondition(v1alpha1.ServiceCondition{
+				Type:    v1alpha1.ServiceLowBalance,
+				Status:  corev1.ConditionTrue,
+				Reason:  "BelowThreshold",
+				Message: fmt.Sprintf("Balance %d is below %d", balance, threshold),
+			})
+		} else {
+			status.SetCondition(v1alpha1.ServiceCondition{
+				Type:   v1alpha1.ServiceLowBalance,
+				Status: corev1.ConditionFalse,
+				Reason: "Sufficient",
+			})
+		}
+	}
+
+	if !equality.Semantic.DeepEqual(status, &codiusService.Status) {
+		codiusService.Status = *status
+		if err := r.Status().Update(ctx, codiusService); err != nil {
+			log.Error(err, "Failed to update balance Status")
+			return err
+		}
+	}
+	return nil
+}
+
+// lowBalanceThreshold returns LOW_BALANCE_THRESHOLD, defaulting to REQUEST_PRICE
+func lowBalanceThreshold() int64 {
+	threshold := os.Getenv("LOW_BALANCE_THRESHOLD")
+	if threshold == "" {
+		threshold = os.Getenv("REQUEST_PRICE")
+	}
+	amount, _ := strconv.ParseInt(threshold, 10, 64)
+	return amount
+}
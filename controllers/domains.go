@@ -0,0 +1,172 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/codius/codius-operator/api/v1alpha1"
+)
+
+// domainVerificationInterval is how often unverified domains are rechecked
+const domainVerificationInterval = time.Minute
+
+// domainRecheckInterval is how often verified domains are rechecked, so that
+// they're unverified once their record is removed
+const domainRecheckInterval = time.Hour
+
+var errChallengeNotFound = errors.New("challenge token not found in DNS TXT record")
+
+// reconcileDomains verifies the ownership of the Codius Service's custom
+// domains, returning how long until they should be rechecked, or zero if it
+// has none
+func (r *ServiceReconciler) reconcileDomains(ctx context.Context, codiusService *v1alpha1.Service) (time.Duration, error) {
+	log := r.Log.WithValues("service", codiusService.Name)
+
+	now := time.Now()
+	previous := map[string]v1alpha1.DomainStatus{}
+	for _, domain := range codiusService.Status.Domains {
+		previous[domain.Name] = domain
+	}
+	verified := codiusService.DeepCopy()
+	verified.Status.Domains = nil
+	for _, name := range codiusService.Domains {
+		domain := v1alpha1.DomainStatus{
+			Name:  name,
+			Token: domainToken(codiusService, name),
+		}
+		prev, ok := previous[name]
+		wasVerified := ok && prev.Verified && prev.Token == domain.Token
+		if wasVerified && prev.CheckedTime != nil && now.Sub(prev.CheckedTime.Time) < domainRecheckInterval {
+			domain = prev
+		} else if err := r.verifyDomain(ctx, name, domain.Token); err == nil {
+			if wasVerified {
+				domain = prev
+			} else {
+				domain.Verified = true
+				domain.VerifiedTime = &metav1.Time{Time: now}
+			}
+			domain.CheckedTime = &metav1.Time{Time: now}
+		} else if wasVerified && !errors.Is(err, errChallengeNotFound) {
+			// Kept verified while the record can't be looked up
+			log.Error(err, "Failed to recheck custom domain", "domain", name)
+			domain = prev
+		} else {
+			if wasVerified {
+				log.Info("Custom domain is no longer verified", "domain", name)
+			}
+			domain.Message = err.Error()
+		}
+		verified.Status.Domains = append(verified.Status.Domains, domain)
+	}
+
+	var domains []v1alpha1.DomainStatus
+	var recheck time.Duration
+	for _, domain := range verified.Status.Domains {
+		if domain.Verified {
+			// Rechecked while verified, in case another service verified the
+			// domain concurrently and the cache didn't observe it in time
+			claimed, err := r.domainClaimed(ctx, verified, domain.Name)
+			if err != nil {
+				return 0, err
+			}
+			if claimed {
+				domain = v1alpha1.DomainStatus{
+					Name:    domain.Name,
+					Token:   domain.Token,
+					Message: "domain is verified by another service",
+				}
+			} else if prev := previous[domain.Name]; !prev.Verified || prev.Token != domain.Token {
+				log.Info("Verified custom domain", "domain", domain.Name)
+			}
+		}
+		after := domainVerificationInterval
+		if domain.Verified && domain.CheckedTime != nil {
+			after = domain.CheckedTime.Add(domainRecheckInterval).Sub(now)
+		}
+		if recheck == 0 || after < recheck {
+			recheck = after
+		}
+		domains = append(domains, domain)
+	}
+
+	if !equality.Semantic.DeepEqual(domains, codiusService.Status.Domains) {
+		codiusService.Status.Domains = domains
+		if err := r.Status().Update(ctx, codiusService); err != nil {
+			log.Error(err, "Failed to update domain Status")
+			return 0, err
+		}
+	}
+	return recheck, nil
+}
+
+// domainClaimed reports whether another Codius Service's verification of the
+// domain precedes this one's
+func (r *ServiceReconciler) domainClaimed(ctx context.Context, codiusService *v1alpha1.Service, domain string) (bool, error) {
+	var services v1alpha1.ServiceList
+	if err := r.List(ctx, &services, client.MatchingFields{v1alpha1.VerifiedDomainIndex: domain}); err != nil {
+		return false, err
+	}
+	for i := range services.Items {
+		if svc := &services.Items[i]; svc.Name != codiusService.Name && svc.DomainPrecedes(codiusService, domain) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// domainToken returns the challenge token for the domain, which is unique to
+// this incarnation of the Codius Service
+func domainToken(codiusService *v1alpha1.Service, domain string) string {
+	hash := sha256.Sum256([]byte(string(codiusService.UID) + "/" + domain))
+	return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(hash[:]))
+}
+
+// verifyDomain checks for the token in a "_codius-challenge" DNS TXT record
+// of the domain, returning errChallengeNotFound if it isn't there. The proxy
+// doesn't serve unverified domains, so ownership can't be proven by an HTTP
+// challenge response from the host.
+func (r *ServiceReconciler) verifyDomain(ctx context.Context, domain, token string) error {
+	lookupTXT := r.LookupTXT
+	if lookupTXT == nil {
+		lookupTXT = net.DefaultResolver.LookupTXT
+	}
+	records, err := lookupTXT(ctx, "_codius-challenge."+domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return errChallengeNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to look up challenge DNS TXT record: %w", err)
+	}
+	for _, record := range records {
+		if strings.TrimSpace(record) == token {
+			return nil
+		}
+	}
+	return errChallengeNotFound
+}
@@ -0,0 +1,178 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/codius/codius-operator/api/v1alpha1"
+)
+
+var _ = Describe("Domains", func() {
+	var (
+		records map[string][]string
+		lookups int
+		k8s     client.Client
+		r       *ServiceReconciler
+	)
+
+	withDomain := func(name string) *v1alpha1.Service {
+		return &v1alpha1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				UID:  types.UID(name + "-uid"),
+				Labels: map[string]string{
+					"codius.org/immutable": "false",
+				},
+			},
+			Domains: []string{"example.com"},
+		}
+	}
+
+	get := func(name string) *v1alpha1.Service {
+		var codiusService v1alpha1.Service
+		ExpectWithOffset(1, k8s.Get(context.Background(), types.NamespacedName{Name: name}, &codiusService)).To(Succeed())
+		return &codiusService
+	}
+
+	// publish sets the service's challenge TXT record for the domain
+	publish := func(codiusService *v1alpha1.Service) {
+		records["_codius-challenge.example.com"] = []string{domainToken(codiusService, "example.com")}
+	}
+
+	BeforeEach(func() {
+		records = map[string][]string{}
+		lookups = 0
+		k8s = fake.NewFakeClientWithScheme(scheme.Scheme, withDomain("one"), withDomain("two"))
+		r = &ServiceReconciler{
+			Client: k8s,
+			Log:    logf.Log.WithName("controllers").WithName("Service"),
+			Scheme: scheme.Scheme,
+			LookupTXT: func(ctx context.Context, name string) ([]string, error) {
+				lookups++
+				if txt, ok := records[name]; ok {
+					return txt, nil
+				}
+				return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+			},
+		}
+	})
+
+	It("verifies domains once their challenge record is published", func() {
+		recheck, err := r.reconcileDomains(context.Background(), get("one"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recheck).To(Equal(domainVerificationInterval))
+		domain := get("one").Status.Domains[0]
+		Expect(domain.Verified).To(BeFalse())
+		Expect(domain.Message).To(Equal(errChallengeNotFound.Error()))
+
+		publish(get("one"))
+		recheck, err = r.reconcileDomains(context.Background(), get("one"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recheck).To(BeNumerically("~", domainRecheckInterval, time.Second))
+		domain = get("one").Status.Domains[0]
+		Expect(domain.Verified).To(BeTrue())
+		Expect(domain.VerifiedTime).NotTo(BeNil())
+		Expect(domain.CheckedTime).NotTo(BeNil())
+	})
+
+	It("rechecks verified domains only once the recheck interval has passed", func() {
+		publish(get("one"))
+		_, err := r.reconcileDomains(context.Background(), get("one"))
+		Expect(err).NotTo(HaveOccurred())
+		delete(records, "_codius-challenge.example.com")
+
+		_, err = r.reconcileDomains(context.Background(), get("one"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lookups).To(Equal(1))
+		Expect(get("one").Status.Domains[0].Verified).To(BeTrue())
+
+		codiusService := get("one")
+		checked := metav1.NewTime(time.Now().Add(-domainRecheckInterval))
+		codiusService.Status.Domains[0].CheckedTime = &checked
+		Expect(k8s.Status().Update(context.Background(), codiusService)).To(Succeed())
+		recheck, err := r.reconcileDomains(context.Background(), get("one"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recheck).To(Equal(domainVerificationInterval))
+		domain := get("one").Status.Domains[0]
+		Expect(domain.Verified).To(BeFalse())
+		Expect(domain.VerifiedTime).To(BeNil())
+	})
+
+	It("keeps verified domains while their record can't be looked up", func() {
+		publish(get("one"))
+		_, err := r.reconcileDomains(context.Background(), get("one"))
+		Expect(err).NotTo(HaveOccurred())
+		verifiedTime := get("one").Status.Domains[0].VerifiedTime
+
+		codiusService := get("one")
+		checked := metav1.NewTime(time.Now().Add(-domainRecheckInterval))
+		codiusService.Status.Domains[0].CheckedTime = &checked
+		Expect(k8s.Status().Update(context.Background(), codiusService)).To(Succeed())
+		r.LookupTXT = func(ctx context.Context, name string) ([]string, error) {
+			return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+		}
+		_, err = r.reconcileDomains(context.Background(), get("one"))
+		Expect(err).NotTo(HaveOccurred())
+		domain := get("one").Status.Domains[0]
+		Expect(domain.Verified).To(BeTrue())
+		Expect(domain.VerifiedTime.Time).To(BeTemporally("==", verifiedTime.Time))
+	})
+
+	It("gives domains verified by several services to the earliest", func() {
+		publish(get("one"))
+		_, err := r.reconcileDomains(context.Background(), get("one"))
+		Expect(err).NotTo(HaveOccurred())
+
+		records["_codius-challenge.example.com"] = append(records["_codius-challenge.example.com"], domainToken(get("two"), "example.com"))
+		_, err = r.reconcileDomains(context.Background(), get("two"))
+		Expect(err).NotTo(HaveOccurred())
+		domain := get("two").Status.Domains[0]
+		Expect(domain.Verified).To(BeFalse())
+		Expect(domain.Message).To(Equal("domain is verified by another service"))
+		Expect(get("one").Status.Domains[0].Verified).To(BeTrue())
+
+		// The domain is verified by the other service once it's released
+		codiusService := get("one")
+		codiusService.Status.Domains = nil
+		Expect(k8s.Status().Update(context.Background(), codiusService)).To(Succeed())
+		_, err = r.reconcileDomains(context.Background(), get("two"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(get("two").Status.Domains[0].Verified).To(BeTrue())
+	})
+
+	It("reports errors looking up challenge records", func() {
+		r.LookupTXT = func(ctx context.Context, name string) ([]string, error) {
+			return nil, errors.New("connection refused")
+		}
+		_, err := r.reconcileDomains(context.Background(), get("one"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(get("one").Status.Domains[0].Message).To(ContainSubstring("connection refused"))
+	})
+})
@@ -0,0 +1,189 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/codius/codius-operator/api/v1alpha1"
+	"github.com/codius/codius-operator/payments"
+)
+
+// reconcileHosting charges an always-on Codius Service REPLICA_MINUTE_PRICE
+// for each minute each of its replicas has been available, split between the
+// always-on services sharing its deployment. Services which fail to pay are
+// suspended until their balance covers a replica-minute again.
+func (r *ServiceReconciler) reconcileHosting(ctx context.Context, codiusService *v1alpha1.Service) error {
+	log := r.Log.WithValues("service", codiusService.Name)
+
+	status := codiusService.Status.DeepCopy()
+	now := time.Now()
+	price := replicaMinutePrice()
+	if condition := status.GetCondition(v1alpha1.ServiceHostingCharged); condition != nil && condition.Status == corev1.ConditionFalse &&
+		status.Balance != nil && *status.Balance >= price {
+		status.SetCondition(v1alpha1.ServiceCondition{
+			Type:   v1alpha1.ServiceHostingCharged,
+			Status: corev1.ConditionTrue,
+			Reason: "BalanceRestored",
+		})
+	}
+	if !codiusService.AlwaysOn || status.Suspended || !hostingCharged(status) || status.AvailableReplicas == int32(0) {
+		// Hosting is charged from when the service is next always on and available
+		status.HostingChargedTime = nil
+	} else if status.HostingChargedTime == nil {
+		status.HostingChargedTime = &metav1.Time{Time: now}
+	} else if minutes := int64(now.Sub(status.HostingChargedTime.Time) / time.Minute); minutes > 0 {
+		sharing, err := r.sharingServices(ctx, codiusService)
+		if err != nil {
+			return err
+		}
+		// Rounded up so that the shares cover the deployment's replicas
+		amount := (price*int64(status.AvailableReplicas)*minutes + sharing - 1) / sharing
+		// Recorded before charging, so that the minutes aren't charged again
+		// if the status can't be updated
+		status.HostingChargedTime = &metav1.Time{Time: status.HostingChargedTime.Add(time.Duration(minutes) * time.Minute)}
+		if err := r.updateHostingStatus(ctx, codiusService, status); err != nil {
+			return err
+		}
+		status = codiusService.Status.DeepCopy()
+		// Nothing is spent if hosting is free
+		if amount > 0 {
+			err = payments.Spend(ctx, codiusService.Name, strconv.FormatInt(amount, 10))
+		}
+		switch {
+		case errors.Is(err, payments.ErrUnavailable):
+			// The spend may have been applied, so the minutes aren't charged
+			// again once the payment backend is available
+			log.Error(err, "Failed to charge for hosting", "amount", amount)
+		case err != nil:
+			log.Error(err, "Failed to charge for hosting", "amount", amount)
+			status.SetCondition(v1alpha1.ServiceCondition{
+				Type:    v1alpha1.ServiceHostingCharged,
+				Status:  corev1.ConditionFalse,
+				Reason:  "ChargeFailed",
+				Message: fmt.Sprintf("Failed to charge %d for %d replica-minutes shared by %d services", amount, int64(status.AvailableReplicas)*minutes, sharing),
+			})
+			status.HostingChargedTime = nil
+			// Suspended right away, rather than once the service is idle
+			status.Suspended = true
+		default:
+			status.SetCondition(v1alpha1.ServiceCondition{
+				Type:   v1alpha1.ServiceHostingCharged,
+				Status: corev1.ConditionTrue,
+				Reason: "Charged",
+			})
+		}
+	}
+	return r.updateHostingStatus(ctx, codiusService, status)
+}
+
+// updateHostingStatus updates the Codius Service's status, if it changed
+func (r *ServiceReconciler) updateHostingStatus(ctx context.Context, codiusService *v1alpha1.Service, status *v1alpha1.ServiceStatus) error {
+	if equality.Semantic.DeepEqual(status, &codiusService.Status) {
+		return nil
+	}
+	codiusService.Status = *status
+	if err := r.Status().Update(ctx, codiusService); err != nil {
+		r.Log.Error(err, "Failed to update hosting Status", "service", codiusService.Name)
+		return err
+	}
+	return nil
+}
+
+// sharingServices counts the always-on mutable Codius Services, including
+// this one, whose hosting is charged for the deployment they share
+func (r *ServiceReconciler) sharingServices(ctx context.Context, codiusService *v1alpha1.Service) (int64, error) {
+	var mutableServices v1alpha1.ServiceList
+	if err := r.List(ctx, &mutableServices, client.MatchingLabels{
+		"codius.org/service":   codiusService.Labels["codius.org/service"],
+		"codius.org/immutable": "false",
+	}); err != nil {
+		r.Log.Error(err, "unable to list mutable Services", "service", codiusService.Name)
+		return 0, err
+	}
+	sharing := int64(1)
+	for i := range mutableServices.Items {
+		if svc := &mutableServices.Items[i]; svc.Name != codiusService.Name && keptOn(svc) {
+			sharing++
+		}
+	}
+	return sharing, nil
+}
+
+// keptOn reports whether the mutable Codius Service should keep its
+// deployment scaled up without requests
+func keptOn(codiusService *v1alpha1.Service) bool {
+	return codiusService.AlwaysOn && !codiusService.Status.Suspended && hostingCharged(&codiusService.Status)
+}
+
+// hostingCharged reports whether the service's last hosting charge didn't fail
+func hostingCharged(status *v1alpha1.ServiceStatus) bool {
+	condition := status.GetCondition(v1alpha1.ServiceHostingCharged)
+	return condition == nil || condition.Status != corev1.ConditionFalse
+}
+
+// replicaMinutePrice returns REPLICA_MINUTE_PRICE
+func replicaMinutePrice() int64 {
+	price, _ := strconv.ParseInt(os.Getenv("REPLICA_MINUTE_PRICE"), 10, 64)
+	return price
+}
+
+// enqueueImmutableService enqueues the immutable service of a mutable Codius
+// Service whenever changes to it may affect how the deployment is scaled
+var enqueueImmutableService = handler.Funcs{
+	CreateFunc: func(e event.CreateEvent, q workqueue.RateLimitingInterface) {
+		if codiusService, ok := e.Object.(*v1alpha1.Service); ok && keptOn(codiusService) {
+			enqueueImmutable(codiusService, q)
+		}
+	},
+	UpdateFunc: func(e event.UpdateEvent, q workqueue.RateLimitingInterface) {
+		oldService, ok := e.ObjectOld.(*v1alpha1.Service)
+		if !ok {
+			return
+		}
+		newService, ok := e.ObjectNew.(*v1alpha1.Service)
+		if !ok {
+			return
+		}
+		if keptOn(oldService) != keptOn(newService) || oldService.Status.Suspended != newService.Status.Suspended {
+			enqueueImmutable(newService, q)
+		}
+	},
+}
+
+func enqueueImmutable(codiusService *v1alpha1.Service, q workqueue.RateLimitingInterface) {
+	hash := codiusService.Annotations["codius.org/hash"]
+	if codiusService.Labels["codius.org/immutable"] == "true" || hash == "" {
+		return
+	}
+	q.Add(reconcile.Request{NamespacedName: types.NamespacedName{Name: hash}})
+}
@@ -0,0 +1,243 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/codius/codius-operator/api/v1alpha1"
+)
+
+// conflictingClient fails status updates while conflicts is positive, as if
+// another writer had updated the status first
+type conflictingClient struct {
+	client.Client
+	conflicts *int
+}
+
+func (c conflictingClient) Status() client.StatusWriter {
+	return conflictingStatusWriter{c.Client.Status(), c.conflicts}
+}
+
+type conflictingStatusWriter struct {
+	client.StatusWriter
+	conflicts *int
+}
+
+func (w conflictingStatusWriter) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	if *w.conflicts > 0 {
+		*w.conflicts--
+		return apierrors.NewConflict(v1alpha1.GroupVersion.WithResource("services").GroupResource(), "", errors.New("the object has been modified"))
+	}
+	return w.StatusWriter.Update(ctx, obj, opts...)
+}
+
+var _ = Describe("Hosting", func() {
+	var (
+		verifier *httptest.Server
+		mu       sync.Mutex
+		spent    map[string]string
+		spends   int
+		balance  string
+		funded   bool
+		k8s      client.Client
+		r        *ServiceReconciler
+	)
+
+	alwaysOn := func(name string, status v1alpha1.ServiceStatus) *v1alpha1.Service {
+		return &v1alpha1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					"codius.org/service":   "svc-hash",
+					"codius.org/immutable": "false",
+				},
+				Annotations: map[string]string{
+					"codius.org/hash": "hash",
+				},
+			},
+			AlwaysOn: true,
+			Status:   status,
+		}
+	}
+
+	get := func(name string) *v1alpha1.Service {
+		var codiusService v1alpha1.Service
+		ExpectWithOffset(1, k8s.Get(context.Background(), types.NamespacedName{Name: name}, &codiusService)).To(Succeed())
+		return &codiusService
+	}
+
+	BeforeEach(func() {
+		spent = map[string]string{}
+		spends = 0
+		balance = "100"
+		funded = true
+		verifier = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case strings.HasSuffix(req.URL.Path, ":spend") && !funded:
+				http.Error(rw, "insufficient balance", http.StatusPaymentRequired)
+			case strings.HasSuffix(req.URL.Path, ":spend"):
+				body, _ := ioutil.ReadAll(req.Body)
+				spent[strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/balances/"), ":spend")] = string(body)
+				spends++
+			default:
+				rw.Write([]byte(balance))
+			}
+		}))
+		os.Setenv("RECEIPT_VERIFIER_URL", verifier.URL)
+		os.Setenv("REPLICA_MINUTE_PRICE", "5")
+	})
+
+	JustBeforeEach(func() {
+		r = &ServiceReconciler{
+			Client: k8s,
+			Log:    logf.Log.WithName("controllers").WithName("Service"),
+			Scheme: scheme.Scheme,
+		}
+	})
+
+	AfterEach(func() {
+		verifier.Close()
+		os.Unsetenv("REPLICA_MINUTE_PRICE")
+	})
+
+	Context("with always-on services sharing a deployment", func() {
+		chargedTime := metav1.NewTime(time.Now().Add(-3*time.Minute - time.Second))
+
+		BeforeEach(func() {
+			status := v1alpha1.ServiceStatus{
+				AvailableReplicas:  2,
+				HostingChargedTime: &chargedTime,
+			}
+			k8s = fake.NewFakeClientWithScheme(scheme.Scheme,
+				alwaysOn("one", status),
+				alwaysOn("two", status),
+			)
+		})
+
+		It("splits the charge for the deployment's replica-minutes between them", func() {
+			Expect(r.reconcileHosting(context.Background(), get("one"))).To(Succeed())
+			// 5 per replica-minute, for 2 replicas for 3 minutes, split in two
+			Expect(spent).To(Equal(map[string]string{"one": "15"}))
+
+			codiusService := get("one")
+			Expect(codiusService.Status.HostingChargedTime.Time).To(BeTemporally("~", chargedTime.Add(3*time.Minute), time.Second))
+			condition := codiusService.Status.GetCondition(v1alpha1.ServiceHostingCharged)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(corev1.ConditionTrue))
+		})
+
+		It("doesn't charge the minutes again if their charge can't be recorded", func() {
+			conflicts := 1
+			k8s = conflictingClient{k8s, &conflicts}
+			r.Client = k8s
+			Expect(r.reconcileHosting(context.Background(), get("one"))).NotTo(Succeed())
+			Expect(spends).To(BeZero())
+
+			Expect(r.reconcileHosting(context.Background(), get("one"))).To(Succeed())
+			Expect(r.reconcileHosting(context.Background(), get("one"))).To(Succeed())
+			Expect(spent).To(Equal(map[string]string{"one": "15"}))
+			Expect(spends).To(Equal(1))
+		})
+
+		It("doesn't spend anything while hosting is free", func() {
+			os.Setenv("REPLICA_MINUTE_PRICE", "0")
+			Expect(r.reconcileHosting(context.Background(), get("one"))).To(Succeed())
+			Expect(spends).To(BeZero())
+			Expect(get("one").Status.HostingChargedTime.Time).To(BeTemporally("~", chargedTime.Add(3*time.Minute), time.Second))
+		})
+
+		It("suspends services right away once their charge fails", func() {
+			funded = false
+			Expect(r.reconcileHosting(context.Background(), get("one"))).To(Succeed())
+
+			codiusService := get("one")
+			Expect(codiusService.Status.Suspended).To(BeTrue())
+			Expect(codiusService.Status.HostingChargedTime).To(BeNil())
+			Expect(keptOn(codiusService)).To(BeFalse())
+			condition := codiusService.Status.GetCondition(v1alpha1.ServiceHostingCharged)
+			Expect(condition.Status).To(Equal(corev1.ConditionFalse))
+			Expect(condition.Reason).To(Equal("ChargeFailed"))
+
+			// The other service is charged for the whole deployment from now on
+			funded = true
+			Expect(r.reconcileHosting(context.Background(), get("two"))).To(Succeed())
+			Expect(spent).To(Equal(map[string]string{"two": "30"}))
+		})
+
+		It("keeps services suspended until their balance covers a replica-minute", func() {
+			funded = false
+			Expect(r.reconcileHosting(context.Background(), get("one"))).To(Succeed())
+
+			balance = "3"
+			Expect(r.reconcileBalance(context.Background(), get("one"))).To(Succeed())
+			Expect(r.reconcileHosting(context.Background(), get("one"))).To(Succeed())
+			Expect(get("one").Status.Suspended).To(BeTrue())
+
+			balance = "5"
+			Expect(r.reconcileBalance(context.Background(), get("one"))).To(Succeed())
+			Expect(r.reconcileHosting(context.Background(), get("one"))).To(Succeed())
+			codiusService := get("one")
+			Expect(codiusService.Status.Suspended).To(BeFalse())
+			Expect(keptOn(codiusService)).To(BeTrue())
+			// Charged from now on
+			Expect(codiusService.Status.HostingChargedTime.Time).To(BeTemporally("~", time.Now(), time.Second))
+		})
+	})
+
+	Context("with services which aren't always on or available", func() {
+		BeforeEach(func() {
+			chargedTime := metav1.NewTime(time.Now().Add(-time.Hour))
+			notAlwaysOn := alwaysOn("notalwayson", v1alpha1.ServiceStatus{AvailableReplicas: 1, HostingChargedTime: &chargedTime})
+			notAlwaysOn.AlwaysOn = false
+			k8s = fake.NewFakeClientWithScheme(scheme.Scheme,
+				notAlwaysOn,
+				alwaysOn("unavailable", v1alpha1.ServiceStatus{HostingChargedTime: &chargedTime}),
+			)
+		})
+
+		It("doesn't charge them", func() {
+			Expect(r.reconcileHosting(context.Background(), get("notalwayson"))).To(Succeed())
+			Expect(r.reconcileHosting(context.Background(), get("unavailable"))).To(Succeed())
+			Expect(spent).To(BeEmpty())
+			Expect(get("notalwayson").Status.HostingChargedTime).To(BeNil())
+			Expect(get("unavailable").Status.HostingChargedTime).To(BeNil())
+		})
+	})
+})
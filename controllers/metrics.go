@@ -0,0 +1,46 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	scaleEventsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "codius_service_scale_events_total",
+			Help: "Total number of times service deployments were scaled, by direction (up or down).",
+		},
+		[]string{"direction"},
+	)
+	coldStartDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "codius_service_cold_start_duration_seconds",
+			Help:    "Time from scaling up a service deployment from zero until a replica is available.",
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+		},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		scaleEventsTotal,
+		coldStartDuration,
+	)
+}
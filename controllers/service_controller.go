@@ -34,15 +34,22 @@ import (
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"github.com/codius/codius-operator/api/v1alpha1"
 )
 
+// scaleUpTimeAnnotation records when a Deployment was scaled up from zero
+const scaleUpTimeAnnotation = "codius.org/scale-up-time"
+
 // ServiceReconciler reconciles a Service object
 type ServiceReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+	// LookupTXT looks up the DNS TXT records verifying custom domains.
+	// Defaults to net.DefaultResolver.LookupTXT.
+	LookupTXT func(ctx context.Context, name string) ([]string, error)
 }
 
 // +kubebuilder:rbac:groups=core.codius.org,resources=services,verbs=get;list;watch;create;update;patch;delete
@@ -77,16 +84,28 @@ func (r *ServiceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 				log.Error(err, "Failed to create new immutable Service", "Service.Name", immutableService.Name)
 				return ctrl.Result{}, err
 			}
-
-			// Immutable Service created successfully - don't requeue
-			return ctrl.Result{}, nil
 		} else if err != nil {
 			log.Error(err, "Failed to get immutable Service")
 			return ctrl.Result{}, err
 		}
-		// Immutable Service already exists - don't requeue
-		log.Info("Skip reconcile: Immutable Service already exists", "Service.Name", immutableService.Name)
-		return ctrl.Result{}, nil
+
+		recheck, err := r.reconcileDomains(ctx, &codiusService)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.reconcileBalance(ctx, &codiusService); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.reconcileHosting(ctx, &codiusService); err != nil {
+			return ctrl.Result{}, err
+		}
+		if codiusService.AlwaysOn && (recheck == 0 || balancePollInterval < recheck) {
+			// Requeue to charge for hosting and poll the balance. Other
+			// services' balances are polled as their usage is recorded.
+			return ctrl.Result{RequeueAfter: balancePollInterval}, nil
+		}
+		// Requeue to recheck custom domains, if any
+		return ctrl.Result{RequeueAfter: recheck}, nil
 	}
 
 	// Check if the deployment already exists, if not create a new one
@@ -137,6 +156,15 @@ func (r *ServiceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return ctrl.Result{}, err
 	}
 
+	// The cold start ends when the scaled up deployment's first replica
+	// becomes available. The annotation is removed when it's scaled down.
+	if scaleUpTime, ok := deployment.Annotations[scaleUpTimeAnnotation]; ok &&
+		codiusService.Status.AvailableReplicas == int32(0) && deployment.Status.AvailableReplicas > int32(0) {
+		if t, err := time.Parse(time.RFC3339Nano, scaleUpTime); err == nil {
+			coldStartDuration.Observe(time.Since(t).Seconds())
+		}
+	}
+
 	codiusService.Status.AvailableReplicas = deployment.Status.AvailableReplicas
 	codiusService.Status.UnavailableReplicas = deployment.Status.UnavailableReplicas
 	if service.Annotations["codius.org/last-request-time"] != "" {
@@ -160,32 +188,53 @@ func (r *ServiceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		log.Error(err, "unable to list mutable Services")
 		return ctrl.Result{}, err
 	}
+	// The deployment is scaled down if every service referencing it is
+	// suspended, and kept up if any is always on
+	suspended := len(mutableServices.Items) > 0
+	alwaysOn := false
 	for _, svc := range mutableServices.Items {
-		svc.Status = codiusService.Status
+		suspended = suspended && svc.Status.Suspended
+		alwaysOn = alwaysOn || keptOn(&svc)
+		// Mutable services keep their own custom domain, balance and suspension status
+		svc.Status.LastRequestTime = codiusService.Status.LastRequestTime
+		svc.Status.AvailableReplicas = codiusService.Status.AvailableReplicas
+		svc.Status.UnavailableReplicas = codiusService.Status.UnavailableReplicas
 		if err := r.Status().Update(ctx, &svc); err != nil {
 			log.Error(err, "Failed to update mutable Service Status", "Service.Name", svc.Name)
 			return ctrl.Result{}, err
 		}
 	}
 
-	if codiusService.Status.LastRequestTime == nil || codiusService.Status.LastRequestTime.Add(time.Minute).Before(time.Now()) {
+	if suspended || (!alwaysOn && (codiusService.Status.LastRequestTime == nil || codiusService.Status.LastRequestTime.Add(time.Minute).Before(time.Now()))) {
 		if *deployment.Spec.Replicas >= int32(1) {
 			replicas := int32(0)
 			deployment.Spec.Replicas = &replicas
+			delete(deployment.Annotations, scaleUpTimeAnnotation)
 			if err := r.Update(ctx, &deployment); err != nil {
 				log.Error(err, "Failed to scale down Deployment", "Deployment.Namespace", deployment.Namespace, "Deployment.Name", deployment.Name)
 				return ctrl.Result{}, err
 			}
+			scaleEventsTotal.WithLabelValues("down").Inc()
 			return ctrl.Result{}, nil
 		}
 	} else {
 		if *deployment.Spec.Replicas == int32(0) {
 			replicas := int32(1)
 			deployment.Spec.Replicas = &replicas
+			if deployment.Annotations == nil {
+				deployment.Annotations = map[string]string{}
+			}
+			// Recorded to measure the cold start once a replica is available
+			deployment.Annotations[scaleUpTimeAnnotation] = time.Now().Format(time.RFC3339Nano)
 			if err := r.Update(ctx, &deployment); err != nil {
 				log.Error(err, "Failed to scale up Deployment", "Deployment.Namespace", deployment.Namespace, "Deployment.Name", deployment.Name)
 				return ctrl.Result{}, err
 			}
+			scaleEventsTotal.WithLabelValues("up").Inc()
+		}
+		if alwaysOn {
+			// Always-on services are requeued once they no longer are
+			return ctrl.Result{}, nil
 		}
 		// Requeue a minute after the last request to try to scale down
 		return ctrl.Result{
@@ -213,6 +262,10 @@ func deploymentForCR(cr *v1alpha1.Service) (*appsv1.Deployment, error) {
 				Value: value,
 			}
 		}
+		var resources corev1.ResourceRequirements
+		if container.Resources != nil {
+			resources = *container.Resources
+		}
 		containers[i] = corev1.Container{
 			Name:           container.Name,
 			Image:          container.Image,
@@ -222,6 +275,7 @@ func deploymentForCR(cr *v1alpha1.Service) (*appsv1.Deployment, error) {
 			Env:            envVars,
 			LivenessProbe:  container.LivenessProbe,
 			ReadinessProbe: container.ReadinessProbe,
+			Resources:      resources,
 			StartupProbe:   container.StartupProbe,
 		}
 	}
@@ -276,6 +330,22 @@ func deploymentForCR(cr *v1alpha1.Service) (*appsv1.Deployment, error) {
 
 func serviceForCR(cr *v1alpha1.Service) *corev1.Service {
 	labels := labelsForCR(cr)
+	ports := []corev1.ServicePort{
+		{
+			Name: "http",
+			Port: 80,
+			// Currently unable to convert int32 to IntOrString...
+			// https://godoc.org/k8s.io/apimachinery/pkg/util/intstr#IntOrString
+			TargetPort: intstr.FromInt(int(cr.Spec.Port)),
+		},
+	}
+	for _, port := range cr.Spec.Ports {
+		ports = append(ports, corev1.ServicePort{
+			Name:       port.Name,
+			Port:       port.Port,
+			TargetPort: intstr.FromInt(int(port.Port)),
+		})
+	}
 	return &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			// Service names must be DNS-1035 labels
@@ -288,14 +358,7 @@ func serviceForCR(cr *v1alpha1.Service) *corev1.Service {
 		},
 		Spec: corev1.ServiceSpec{
 			Selector: labels,
-			Ports: []corev1.ServicePort{
-				{
-					Port: 80,
-					// Currently unable to convert int32 to IntOrString...
-					// https://godoc.org/k8s.io/apimachinery/pkg/util/intstr#IntOrString
-					TargetPort: intstr.FromInt(int(cr.Spec.Port)),
-				},
-			},
+			Ports:    ports,
 		},
 	}
 }
@@ -307,9 +370,16 @@ func labelsForCR(cr *v1alpha1.Service) map[string]string {
 }
 
 func (r *ServiceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.GetFieldIndexer().IndexField(&v1alpha1.Service{}, v1alpha1.VerifiedDomainIndex, func(obj runtime.Object) []string {
+		return obj.(*v1alpha1.Service).VerifiedDomains()
+	}); err != nil {
+		return err
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&v1alpha1.Service{}).
 		Owns(&corev1.Service{}).
 		Owns(&appsv1.Deployment{}).
+		Watches(&source.Kind{Type: &v1alpha1.Service{}}, enqueueImmutableService).
 		Complete(r)
 }
@@ -0,0 +1,142 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/codius/codius-operator/api/v1alpha1"
+)
+
+var _ = Describe("Scaling", func() {
+	var (
+		k8s client.Client
+		r   *ServiceReconciler
+	)
+
+	coldStarts := func() uint64 {
+		var m dto.Metric
+		ExpectWithOffset(1, coldStartDuration.Write(&m)).To(Succeed())
+		return m.GetHistogram().GetSampleCount()
+	}
+
+	getDeployment := func() *appsv1.Deployment {
+		var deployment appsv1.Deployment
+		ExpectWithOffset(1, k8s.Get(context.Background(), types.NamespacedName{Name: "hash"}, &deployment)).To(Succeed())
+		return &deployment
+	}
+
+	BeforeEach(func() {
+		replicas := int32(0)
+		k8s = fake.NewFakeClientWithScheme(scheme.Scheme,
+			&v1alpha1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "hash",
+					Labels: map[string]string{
+						"codius.org/service":   "svc-hash",
+						"codius.org/immutable": "true",
+					},
+				},
+			},
+			&v1alpha1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "hello",
+					Labels: map[string]string{
+						"codius.org/service":   "svc-hash",
+						"codius.org/immutable": "false",
+					},
+				},
+			},
+			&appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "hash"},
+				Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+			},
+			&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "svc-hash",
+					Annotations: map[string]string{
+						"codius.org/last-request-time": time.Now().Format(time.RFC3339),
+					},
+				},
+			},
+		)
+		r = &ServiceReconciler{
+			Client: k8s,
+			Log:    logf.Log.WithName("controllers").WithName("Service"),
+			Scheme: scheme.Scheme,
+		}
+	})
+
+	It("counts scaling from zero and measures the cold start", func() {
+		scaledUp := testutil.ToFloat64(scaleEventsTotal.WithLabelValues("up"))
+		started := coldStarts()
+
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: "hash"}})
+		Expect(err).NotTo(HaveOccurred())
+		deployment := getDeployment()
+		Expect(*deployment.Spec.Replicas).To(Equal(int32(1)))
+		Expect(deployment.Annotations).To(HaveKey(scaleUpTimeAnnotation))
+		Expect(testutil.ToFloat64(scaleEventsTotal.WithLabelValues("up"))).To(Equal(scaledUp + 1))
+		Expect(coldStarts()).To(Equal(started))
+
+		// The cold start ends once a replica is available, and is only
+		// measured once
+		deployment.Status.AvailableReplicas = 1
+		Expect(k8s.Update(context.Background(), deployment)).To(Succeed())
+		for i := 0; i < 2; i++ {
+			_, err = r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: "hash"}})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(coldStarts()).To(Equal(started + 1))
+		Expect(testutil.ToFloat64(scaleEventsTotal.WithLabelValues("up"))).To(Equal(scaledUp + 1))
+	})
+
+	It("counts scaling down once the service is idle", func() {
+		scaledDown := testutil.ToFloat64(scaleEventsTotal.WithLabelValues("down"))
+		deployment := getDeployment()
+		replicas := int32(1)
+		deployment.Spec.Replicas = &replicas
+		deployment.Annotations = map[string]string{scaleUpTimeAnnotation: time.Now().Format(time.RFC3339Nano)}
+		Expect(k8s.Update(context.Background(), deployment)).To(Succeed())
+		var service corev1.Service
+		Expect(k8s.Get(context.Background(), types.NamespacedName{Name: "svc-hash"}, &service)).To(Succeed())
+		service.Annotations["codius.org/last-request-time"] = time.Now().Add(-2 * time.Minute).Format(time.RFC3339)
+		Expect(k8s.Update(context.Background(), &service)).To(Succeed())
+
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: "hash"}})
+		Expect(err).NotTo(HaveOccurred())
+		deployment = getDeployment()
+		Expect(*deployment.Spec.Replicas).To(BeZero())
+		Expect(deployment.Annotations).NotTo(HaveKey(scaleUpTimeAnnotation))
+		Expect(testutil.ToFloat64(scaleEventsTotal.WithLabelValues("down"))).To(Equal(scaledDown + 1))
+	})
+})
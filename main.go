@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -27,6 +28,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	corev1alpha1 "github.com/codius/codius-operator/api/v1alpha1"
+	"github.com/codius/codius-operator/certs"
 	"github.com/codius/codius-operator/controllers"
 	"github.com/codius/codius-operator/servers"
 	// +kubebuilder:scaffold:imports
@@ -48,10 +50,12 @@ func main() {
 	var metricsAddr string
 	var servicesApiAddr string
 	var proxyAddr string
+	var proxyTLSAddr string
 	var enableLeaderElection bool
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&servicesApiAddr, "services-api-addr", ":8081", "The address the services API endpoint binds to.")
 	flag.StringVar(&proxyAddr, "proxy-addr", ":8082", "The address the services proxy endpoint binds to.")
+	flag.StringVar(&proxyTLSAddr, "proxy-tls-addr", ":8443", "The address the services proxy TLS endpoint binds to, if ACME_DIRECTORY_URL is set.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -59,6 +63,11 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 
+	if os.Getenv("CODIUS_HOST_KEY") == "" {
+		setupLog.Info("CODIUS_HOST_KEY must be set")
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
@@ -87,16 +96,43 @@ func main() {
 	if err = mgr.Add(&servers.ServicesApi{
 		BindAddress: servicesApiAddr,
 		Client:      mgr.GetClient(),
+		APIReader:   mgr.GetAPIReader(),
 		Log:         ctrl.Log.WithName("servers").WithName("Services API"),
 	}); err != nil {
 		setupLog.Error(err, "unable to create services API web server", "server", "Services API")
 		os.Exit(1)
 	}
-	if err = mgr.Add(&servers.Proxy{
-		BindAddress: proxyAddr,
-		Client:      mgr.GetClient(),
-		Log:         ctrl.Log.WithName("servers").WithName("Proxy"),
-	}); err != nil {
+	proxy := &servers.Proxy{
+		BindAddress:    proxyAddr,
+		TLSBindAddress: proxyTLSAddr,
+		Client:         mgr.GetClient(),
+		Log:            ctrl.Log.WithName("servers").WithName("Proxy"),
+	}
+	if directoryURL := os.Getenv("ACME_DIRECTORY_URL"); directoryURL != "" {
+		http01 := &certs.HTTP01Solver{
+			Client:    mgr.GetClient(),
+			Namespace: os.Getenv("CODIUS_NAMESPACE"),
+		}
+		solvers := []certs.Solver{http01}
+		if hookURL := os.Getenv("ACME_DNS_HOOK_URL"); hookURL != "" {
+			solvers = append(solvers, &certs.HookDNS01Solver{
+				URL:              hookURL,
+				PropagationDelay: time.Minute,
+			})
+		}
+		proxy.ACMEChallenges = http01
+		proxy.Certificates = &certs.Manager{
+			Client:       mgr.GetClient(),
+			Log:          ctrl.Log.WithName("certs"),
+			DirectoryURL: directoryURL,
+			Email:        os.Getenv("ACME_EMAIL"),
+			Namespace:    os.Getenv("CODIUS_NAMESPACE"),
+			Hostname:     os.Getenv("CODIUS_HOSTNAME"),
+			Solvers:      solvers,
+			HostPolicy:   proxy.HostPolicy,
+		}
+	}
+	if err = mgr.Add(proxy); err != nil {
 		setupLog.Error(err, "unable to create services proxy web server", "server", "Proxy")
 		os.Exit(1)
 	}
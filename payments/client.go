@@ -0,0 +1,287 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package payments spends and credits balances held by the receipt verifier.
+package payments
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrInsufficientFunds is returned when the balance can't cover a spend
+	ErrInsufficientFunds = errors.New("payments: insufficient funds")
+	// ErrUnavailable is returned when the payment backend can't be reached,
+	// fails, or has failed too often recently
+	ErrUnavailable = errors.New("payments: payment backend unavailable")
+)
+
+// Error is a request rejected by the payment backend
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("payments: %d %s", e.StatusCode, e.Message)
+}
+
+// Unwrap allows rejections to be tested for ErrInsufficientFunds. Only 402
+// Payment Required means the balance can't cover a spend; other rejections,
+// such as conflicting reuse of an Idempotency-Key, are not.
+func (e *Error) Unwrap() error {
+	if e.StatusCode == http.StatusPaymentRequired {
+		return ErrInsufficientFunds
+	}
+	return nil
+}
+
+const (
+	defaultTimeout          = 5 * time.Second
+	defaultMaxRetries       = 2
+	defaultRetryBackoff     = 100 * time.Millisecond
+	defaultFailureThreshold = 5
+	defaultCooldown         = 30 * time.Second
+	maxResponseSize         = 4096
+)
+
+// Client talks to the receipt verifier. Requests are retried with the same
+// Idempotency-Key if the backend is unavailable, and fail fast with
+// ErrUnavailable once it has been unavailable FailureThreshold times in a row,
+// until Cooldown has passed.
+type Client struct {
+	// Receipt verifier url. Defaults to RECEIPT_VERIFIER_URL.
+	URL string
+	// Client for requests to the receipt verifier. Defaults to a client with
+	// a 5 second timeout.
+	HTTPClient *http.Client
+	// Number of times to retry a request. Defaults to 2, negative values
+	// disable retries.
+	MaxRetries int
+	// Delay before the first retry, doubled for each retry. Defaults to 100ms.
+	RetryBackoff time.Duration
+	// Consecutive failures after which requests fail fast. Defaults to 5.
+	FailureThreshold int
+	// How long to fail fast before trying the backend again. Defaults to 30s.
+	Cooldown time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+}
+
+var defaultHTTPClient = &http.Client{Timeout: defaultTimeout}
+
+// DefaultClient is used by the package-level functions
+var DefaultClient = &Client{}
+
+// Spend deducts the amount from the balance using DefaultClient
+func Spend(ctx context.Context, id string, amount string) error {
+	return DefaultClient.Spend(ctx, id, amount)
+}
+
+// Balance returns the amount remaining in the balance using DefaultClient
+func Balance(ctx context.Context, id string) (int64, error) {
+	return DefaultClient.Balance(ctx, id)
+}
+
+// CreditReceipt credits the receipt to the balance using DefaultClient
+func CreditReceipt(ctx context.Context, id string, receipt string) (int64, error) {
+	return DefaultClient.CreditReceipt(ctx, id, receipt)
+}
+
+// Refund credits a previously spent amount back to the balance using
+// DefaultClient
+func Refund(ctx context.Context, id string, amount string) error {
+	return DefaultClient.Refund(ctx, id, amount)
+}
+
+// Spend deducts the amount from the balance
+func (c *Client) Spend(ctx context.Context, id string, amount string) error {
+	_, err := c.call(ctx, "spend", "POST", balancePath(id)+":spend", amount)
+	return err
+}
+
+// Refund credits a previously spent amount back to the balance
+func (c *Client) Refund(ctx context.Context, id string, amount string) error {
+	_, err := c.call(ctx, "refund", "POST", balancePath(id)+":refund", amount)
+	return err
+}
+
+// Balance returns the amount remaining in the balance
+func (c *Client) Balance(ctx context.Context, id string) (int64, error) {
+	body, err := c.call(ctx, "balance", "GET", balancePath(id), "")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(body), 10, 64)
+}
+
+// CreditReceipt verifies the STREAM receipt and credits its amount to the
+// balance, returning the new balance
+func (c *Client) CreditReceipt(ctx context.Context, id string, receipt string) (int64, error) {
+	body, err := c.call(ctx, "credit", "POST", balancePath(id)+":creditReceipt", receipt)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(body), 10, 64)
+}
+
+// balancePath returns the path of the balance. The id may be a bearer token,
+// so it's escaped, including the colons separating custom methods, so that it
+// can't address another balance or method.
+func balancePath(id string) string {
+	return "/balances/" + strings.Replace(url.PathEscape(id), ":", "%3A", -1)
+}
+
+func (c *Client) call(ctx context.Context, operation, method, path, body string) (string, error) {
+	if !c.allow() {
+		verifierFailuresTotal.WithLabelValues(operation, "circuit_open").Inc()
+		return "", fmt.Errorf("%w: too many recent failures", ErrUnavailable)
+	}
+	baseURL := c.URL
+	if baseURL == "" {
+		baseURL = os.Getenv("RECEIPT_VERIFIER_URL")
+	}
+	// Retries of the request are recognizable by the backend from the key
+	idempotencyKey := uuid.New().String()
+	backoff := c.RetryBackoff
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+	maxRetries := c.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultMaxRetries
+	} else if maxRetries < 0 {
+		maxRetries = 0
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		var resp string
+		resp, err = c.do(ctx, operation, method, baseURL+path, body, idempotencyKey)
+		if err == nil || !errors.Is(err, ErrUnavailable) {
+			c.record(true)
+			return resp, err
+		}
+		if attempt >= maxRetries {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("%w: %v", ErrUnavailable, ctx.Err())
+		case <-time.After(backoff << uint(attempt)):
+		}
+	}
+	// Callers giving up aren't failures of the backend
+	if ctx.Err() == nil {
+		c.record(false)
+	}
+	return "", err
+}
+
+func (c *Client) do(ctx context.Context, operation, method, url, body, idempotencyKey string) (string, error) {
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = defaultHTTPClient
+	}
+	start := time.Now()
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	verifierRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		verifierFailuresTotal.WithLabelValues(operation, "error").Inc()
+		return "", fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		verifierFailuresTotal.WithLabelValues(operation, "error").Inc()
+		return "", fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		verifierFailuresTotal.WithLabelValues(operation, "error").Inc()
+		return "", fmt.Errorf("%w: %d %s", ErrUnavailable, resp.StatusCode, b)
+	}
+	if resp.StatusCode != http.StatusOK {
+		verifierFailuresTotal.WithLabelValues(operation, "rejected").Inc()
+		return "", &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+	}
+	return string(b), nil
+}
+
+// allow reports whether a request may be sent to the backend, allowing a
+// single trial request once the cooldown has passed
+func (c *Client) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures < c.failureThreshold() {
+		return true
+	}
+	if time.Since(c.openedAt) < c.cooldown() {
+		return false
+	}
+	// Fail fast again until the trial request completes
+	c.openedAt = time.Now()
+	return true
+}
+
+// record tracks consecutive failures to reach the backend
+func (c *Client) record(ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ok {
+		c.failures = 0
+		return
+	}
+	c.failures++
+	if c.failures >= c.failureThreshold() {
+		c.openedAt = time.Now()
+	}
+}
+
+func (c *Client) failureThreshold() int {
+	if c.FailureThreshold == 0 {
+		return defaultFailureThreshold
+	}
+	return c.FailureThreshold
+}
+
+func (c *Client) cooldown() time.Duration {
+	if c.Cooldown == 0 {
+		return defaultCooldown
+	}
+	return c.Cooldown
+}
@@ -0,0 +1,193 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package payments
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client", func() {
+	var (
+		verifier *httptest.Server
+		mu       sync.Mutex
+		requests []*http.Request
+		bodies   []string
+		statuses []int
+		c        *Client
+	)
+
+	// respond sets the statuses of successive responses, repeating the last
+	respond := func(codes ...int) {
+		mu.Lock()
+		defer mu.Unlock()
+		statuses = codes
+	}
+
+	received := func() []*http.Request {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+
+	BeforeEach(func() {
+		requests, bodies = nil, nil
+		respond(http.StatusOK)
+		verifier = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			mu.Lock()
+			requests = append(requests, req)
+			bodies = append(bodies, string(body))
+			status := statuses[0]
+			if len(statuses) > 1 {
+				statuses = statuses[1:]
+			}
+			mu.Unlock()
+			rw.WriteHeader(status)
+			rw.Write([]byte("100\n"))
+		}))
+		c = &Client{
+			URL:          verifier.URL,
+			RetryBackoff: time.Millisecond,
+			Cooldown:     time.Hour,
+		}
+	})
+
+	AfterEach(func() {
+		verifier.Close()
+	})
+
+	It("spends from and reads balances", func() {
+		Expect(c.Spend(context.Background(), "hello", "10")).To(Succeed())
+		Expect(c.Balance(context.Background(), "hello")).To(Equal(int64(100)))
+		Expect(received()[0].Method).To(Equal("POST"))
+		Expect(received()[0].URL.Path).To(Equal("/balances/hello:spend"))
+		Expect(bodies[0]).To(Equal("10"))
+		Expect(received()[1].Method).To(Equal("GET"))
+		Expect(received()[1].URL.Path).To(Equal("/balances/hello"))
+	})
+
+	It("escapes balance ids so they can't address other balances", func() {
+		id := "victim/x:refund?y"
+		Expect(c.Spend(context.Background(), id, "10")).To(Succeed())
+		Expect(c.Refund(context.Background(), id, "10")).To(Succeed())
+		Expect(c.Balance(context.Background(), id)).To(Equal(int64(100)))
+		Expect(c.CreditReceipt(context.Background(), id, "receipt")).To(Equal(int64(100)))
+		Expect(received()).To(HaveLen(4))
+		for i, suffix := range []string{":spend", ":refund", "", ":creditReceipt"} {
+			Expect(received()[i].URL.RawQuery).To(BeEmpty())
+			Expect(received()[i].URL.EscapedPath()).To(Equal("/balances/victim%2Fx%3Arefund%3Fy" + suffix))
+			Expect(received()[i].URL.Path).To(Equal("/balances/" + id + suffix))
+		}
+	})
+
+	It("retries unavailable backends with the same idempotency key", func() {
+		respond(http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK)
+		Expect(c.Spend(context.Background(), "hello", "10")).To(Succeed())
+		Expect(received()).To(HaveLen(3))
+		key := received()[0].Header.Get("Idempotency-Key")
+		Expect(key).NotTo(BeEmpty())
+		for _, req := range received() {
+			Expect(req.Header.Get("Idempotency-Key")).To(Equal(key))
+		}
+
+		Expect(c.Spend(context.Background(), "hello", "10")).To(Succeed())
+		Expect(received()[3].Header.Get("Idempotency-Key")).NotTo(Equal(key))
+	})
+
+	It("gives up once retries are exhausted", func() {
+		respond(http.StatusInternalServerError)
+		err := c.Spend(context.Background(), "hello", "10")
+		Expect(errors.Is(err, ErrUnavailable)).To(BeTrue())
+		Expect(received()).To(HaveLen(1 + defaultMaxRetries))
+	})
+
+	It("doesn't retry if retries are disabled", func() {
+		c.MaxRetries = -1
+		respond(http.StatusInternalServerError)
+		err := c.Spend(context.Background(), "hello", "10")
+		Expect(errors.Is(err, ErrUnavailable)).To(BeTrue())
+		Expect(received()).To(HaveLen(1))
+	})
+
+	It("doesn't retry rejected requests", func() {
+		respond(http.StatusBadRequest)
+		err := c.Spend(context.Background(), "hello", "10")
+		var paymentErr *Error
+		Expect(errors.As(err, &paymentErr)).To(BeTrue())
+		Expect(paymentErr.StatusCode).To(Equal(http.StatusBadRequest))
+		Expect(paymentErr.Message).To(Equal("100"))
+		Expect(errors.Is(err, ErrUnavailable)).To(BeFalse())
+		Expect(received()).To(HaveLen(1))
+	})
+
+	It("maps only 402 Payment Required to insufficient funds", func() {
+		respond(http.StatusPaymentRequired)
+		Expect(errors.Is(c.Spend(context.Background(), "hello", "10"), ErrInsufficientFunds)).To(BeTrue())
+
+		respond(http.StatusConflict)
+		err := c.Spend(context.Background(), "hello", "10")
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Is(err, ErrInsufficientFunds)).To(BeFalse())
+	})
+
+	It("fails fast once the backend has failed too often", func() {
+		c.MaxRetries = -1
+		c.FailureThreshold = 2
+		respond(http.StatusServiceUnavailable)
+		for i := 0; i < 2; i++ {
+			Expect(errors.Is(c.Spend(context.Background(), "hello", "10"), ErrUnavailable)).To(BeTrue())
+		}
+		Expect(received()).To(HaveLen(2))
+
+		err := c.Spend(context.Background(), "hello", "10")
+		Expect(err).To(MatchError(ContainSubstring("too many recent failures")))
+		Expect(received()).To(HaveLen(2))
+	})
+
+	It("tries the backend again after the cooldown", func() {
+		c.MaxRetries = -1
+		c.FailureThreshold = 1
+		c.Cooldown = 10 * time.Millisecond
+		respond(http.StatusServiceUnavailable, http.StatusOK)
+		Expect(errors.Is(c.Spend(context.Background(), "hello", "10"), ErrUnavailable)).To(BeTrue())
+		Expect(errors.Is(c.Spend(context.Background(), "hello", "10"), ErrUnavailable)).To(BeTrue())
+		Expect(received()).To(HaveLen(1))
+
+		time.Sleep(20 * time.Millisecond)
+		Expect(c.Spend(context.Background(), "hello", "10")).To(Succeed())
+		Expect(c.Spend(context.Background(), "hello", "10")).To(Succeed())
+		Expect(received()).To(HaveLen(3))
+	})
+
+	It("doesn't count callers giving up as failures", func() {
+		c.FailureThreshold = 1
+		respond(http.StatusServiceUnavailable, http.StatusOK)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		Expect(errors.Is(c.Spend(ctx, "hello", "10"), ErrUnavailable)).To(BeTrue())
+		Expect(c.Spend(context.Background(), "hello", "10")).To(Succeed())
+	})
+})
@@ -0,0 +1,47 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package payments
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	verifierRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "codius_payment_verifier_request_duration_seconds",
+			Help:    "Latency of requests to the receipt verifier, by operation (spend, refund, balance or credit).",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"operation"},
+	)
+	verifierFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "codius_payment_verifier_failures_total",
+			Help: "Total number of failed requests to the receipt verifier, by operation and reason (error or rejected).",
+		},
+		[]string{"operation", "reason"},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		verifierRequestDuration,
+		verifierFailuresTotal,
+	)
+}
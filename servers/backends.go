@@ -0,0 +1,119 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package servers
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codius/codius-operator/api/v1alpha1"
+	"golang.org/x/net/http2"
+)
+
+var backendDialer = &net.Dialer{
+	Timeout:   5 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// dialBackend connects to services' pods
+var dialBackend = backendDialer.DialContext
+
+// backendTransport is shared by all HTTP/1.1 backends so connections to
+// services are kept alive and reused across requests
+var backendTransport = &http.Transport{
+	DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialBackend(ctx, network, addr)
+	},
+	MaxIdleConns:          1000,
+	MaxIdleConnsPerHost:   100,
+	IdleConnTimeout:       90 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+	// Backends which accept requests but never respond are served the 503
+	// page rather than holding the request open indefinitely
+	ResponseHeaderTimeout: time.Minute,
+}
+
+// h2cTransport proxies gRPC requests to backends over cleartext HTTP/2
+var h2cTransport = &http2.Transport{
+	AllowHTTP: true,
+	DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+		return dialBackend(context.Background(), network, addr)
+	},
+}
+
+type backend struct {
+	url   string
+	proxy *httputil.ReverseProxy
+}
+
+// backendCache holds a reverse proxy per service port. The zero value is ready to use.
+type backendCache struct {
+	mu       sync.Mutex
+	backends map[string]*backend
+}
+
+// get returns the cached reverse proxy for the service port, replacing it if
+// the service's backend url has changed since it was cached
+func (c *backendCache) get(serviceName string, port *v1alpha1.ServicePort, backendUrl string, errorHandler func(http.ResponseWriter, *http.Request, error)) (*httputil.ReverseProxy, error) {
+	key := serviceName
+	if port != nil {
+		key += "/" + port.Name
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, ok := c.backends[key]; ok && b.url == backendUrl {
+		return b.proxy, nil
+	}
+	target, err := url.Parse(backendUrl)
+	if err != nil {
+		return nil, err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = backendTransport
+	proxy.ErrorHandler = errorHandler
+	if port != nil && port.Protocol == v1alpha1.PortProtocolGRPC {
+		proxy.Transport = h2cTransport
+		// Flush streamed responses immediately
+		proxy.FlushInterval = -1
+	}
+	if c.backends == nil {
+		c.backends = map[string]*backend{}
+	}
+	c.backends[key] = &backend{
+		url:   backendUrl,
+		proxy: proxy,
+	}
+	return proxy, nil
+}
+
+// forget removes all cached reverse proxies for the service
+func (c *backendCache) forget(serviceName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.backends {
+		if key == serviceName || strings.HasPrefix(key, serviceName+"/") {
+			delete(c.backends, key)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package servers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/codius/codius-operator/payments"
+	"github.com/codius/codius-operator/servicesapi"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// writeError responds with an Error. The message defaults to the status text.
+func writeError(rw http.ResponseWriter, code int, message string) {
+	writeErrorCauses(rw, code, message, nil)
+}
+
+func writeErrorCauses(rw http.ResponseWriter, code int, message string, causes []servicesapi.ErrorCause) {
+	if message == "" {
+		message = http.StatusText(code)
+	}
+	writeJSON(rw, code, servicesapi.Error{
+		Code:    code,
+		Reason:  strings.Replace(http.StatusText(code), " ", "", -1),
+		Message: message,
+		Causes:  causes,
+	})
+}
+
+// writeAPIError responds with the Error for an error from the API server,
+// including the causes of validation failures
+func writeAPIError(rw http.ResponseWriter, err error) {
+	code := apiErrorStatus(err)
+	if code == http.StatusInternalServerError {
+		// Don't expose internal errors
+		writeError(rw, code, "")
+		return
+	}
+	var causes []servicesapi.ErrorCause
+	message := err.Error()
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		message = status.Status().Message
+		if details := status.Status().Details; details != nil {
+			for _, cause := range details.Causes {
+				causes = append(causes, servicesapi.ErrorCause{
+					Type:    string(cause.Type),
+					Field:   cause.Field,
+					Message: cause.Message,
+				})
+			}
+		}
+	}
+	writeErrorCauses(rw, code, message, causes)
+}
+
+// apiErrorStatus returns the response status for an error from the API server
+func apiErrorStatus(err error) int {
+	switch {
+	case apierrors.IsInvalid(err), apierrors.IsBadRequest(err):
+		return http.StatusBadRequest
+	case apierrors.IsForbidden(err):
+		return http.StatusForbidden
+	case apierrors.IsNotFound(err):
+		return http.StatusNotFound
+	case apierrors.IsConflict(err), apierrors.IsAlreadyExists(err):
+		return http.StatusConflict
+	case apierrors.IsResourceExpired(err):
+		return http.StatusGone
+	case apierrors.IsTooManyRequests(err), apierrors.IsServerTimeout(err), apierrors.IsTimeout(err):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writePaymentError responds with the Error for a payment error
+func writePaymentError(rw http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, payments.ErrInsufficientFunds):
+		writeError(rw, http.StatusPaymentRequired, "Insufficient balance")
+	case errors.Is(err, payments.ErrUnavailable):
+		writeError(rw, http.StatusServiceUnavailable, "Payments are unavailable")
+	default:
+		writeError(rw, http.StatusBadGateway, "")
+	}
+}
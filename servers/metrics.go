@@ -0,0 +1,87 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package servers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	proxyRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "codius_proxy_requests_total",
+			Help: "Total number of requests handled by the proxy, by service and status code.",
+		},
+		[]string{"service", "code"},
+	)
+	proxyRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "codius_proxy_request_duration_seconds",
+			Help:    "Latency of requests handled by the proxy, by service.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"service"},
+	)
+	proxyPagesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "codius_proxy_pages_total",
+			Help: "Total number of Codius web pages served in place of a service, by service and status code (e.g. 402, 503).",
+		},
+		[]string{"service", "code"},
+	)
+	apiServicesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "codius_api_services_total",
+			Help: "Total number of services created, replaced or deleted through the services API, by operation (create, replace or delete).",
+		},
+		[]string{"operation"},
+	)
+	failedRefundsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "codius_api_failed_refunds_total",
+			Help: "Total number of SERVICE_PRICE refunds which failed and were recorded in Secrets to be reconciled.",
+		},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		proxyRequestsTotal,
+		proxyRequestDuration,
+		proxyPagesTotal,
+		apiServicesTotal,
+		failedRefundsTotal,
+	)
+}
+
+// withMetrics records the count and latency of requests by service. Requests
+// for unknown services are recorded with an empty service label.
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: rw}
+		next.ServeHTTP(recorder, req)
+		info := getRequestInfo(req.Context())
+		proxyRequestsTotal.WithLabelValues(info.serviceName, strconv.Itoa(recorder.statusCode())).Inc()
+		proxyRequestDuration.WithLabelValues(info.serviceName).Observe(time.Since(start).Seconds())
+	})
+}
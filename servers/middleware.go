@@ -0,0 +1,163 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package servers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/codius/codius-operator/api/v1alpha1"
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+)
+
+type middleware func(http.Handler) http.Handler
+
+// chain wraps the handler in the middlewares, the first being the outermost
+func chain(handler http.Handler, middlewares ...middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+type contextKey int
+
+const requestInfoKey contextKey = iota
+
+// requestInfo is shared by the middlewares handling a single request
+type requestInfo struct {
+	id            string
+	serviceName   string
+	codiusService *v1alpha1.Service
+	// inbound is the request as received, before a backend proxy rewrote it
+	inbound *http.Request
+}
+
+func getRequestInfo(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// withRequestID tags the request with the incoming X-Request-Id header or a
+// new random id, and echoes it in the response
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-Id")
+		if id == "" {
+			id = uuid.New().String()
+			req.Header.Set("X-Request-Id", id)
+		}
+		rw.Header().Set("X-Request-Id", id)
+		ctx := context.WithValue(req.Context(), requestInfoKey, &requestInfo{id: id})
+		next.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
+
+// withRecovery logs handler panics and responds with 500
+func withRecovery(log logr.Logger) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			defer func() {
+				if rec := recover(); rec != nil {
+					if rec == http.ErrAbortHandler {
+						panic(rec)
+					}
+					log.Error(fmt.Errorf("%v", rec), "Recovered from panic", "id", getRequestInfo(req.Context()).id)
+					rw.WriteHeader(http.StatusInternalServerError)
+				}
+			}()
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// withAccessLog logs every request once it has been served
+func withAccessLog(log logr.Logger) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			recorder := &responseRecorder{ResponseWriter: rw}
+			next.ServeHTTP(recorder, req)
+			log.Info("request",
+				"id", getRequestInfo(req.Context()).id,
+				"host", req.Host,
+				"method", req.Method,
+				"path", req.URL.Path,
+				"status", recorder.statusCode(),
+				"bytes", recorder.written,
+				"duration", time.Since(start).String(),
+			)
+		})
+	}
+}
+
+// responseRecorder records the status code and size of a response. It
+// supports flushing and hijacking for streamed and upgraded connections.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.written += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (r *responseRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
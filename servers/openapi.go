@@ -0,0 +1,301 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package servers
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/codius/codius-operator/api/v1alpha1"
+	"github.com/codius/codius-operator/servicesapi"
+)
+
+// route is a Services API route, from which both the router and the OpenAPI
+// document are built
+type route struct {
+	method    string
+	path      string
+	handle    httprouter.Handle
+	operation operation
+}
+
+type authentication int
+
+const (
+	authNone authentication = iota
+	authRequired
+	// authToken requires the bearer token, rather than an owner key's signature
+	authToken
+)
+
+// operation describes a route in the OpenAPI document
+type operation struct {
+	id      string
+	summary string
+	auth    authentication
+	// parameters are the operation's query and header parameters
+	parameters []parameter
+	// request is the value whose type is the JSON request body, or a string
+	// for a plain text body
+	request interface{}
+	// statuses are the status codes of successful responses
+	statuses []int
+	// response is the value whose type is the JSON response body, if any
+	response interface{}
+}
+
+type parameter struct {
+	in          string
+	name        string
+	typ         string
+	description string
+}
+
+// serveOpenAPI serves the OpenAPI document describing the routes
+func serveOpenAPI(routes []route) httprouter.Handle {
+	data, err := json.Marshal(openAPIDocument(routes))
+	return func(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		if err != nil {
+			writeError(rw, http.StatusInternalServerError, "")
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		rw.Write(data)
+	}
+}
+
+// openAPIDocument returns the OpenAPI 3 document describing the routes, with
+// schemas generated from the types of their request and response bodies
+func openAPIDocument(routes []route) map[string]interface{} {
+	schemas := schemaGenerator{schemas: map[string]interface{}{}}
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(servicesapi.Error{}))},
+		},
+	}
+	paths := map[string]map[string]interface{}{}
+	for _, r := range routes {
+		var parameters []interface{}
+		segments := strings.Split(r.path, "/")
+		for i, segment := range segments {
+			if strings.HasPrefix(segment, ":") {
+				segments[i] = "{" + segment[1:] + "}"
+				parameters = append(parameters, map[string]interface{}{
+					"name":     segment[1:],
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]interface{}{"type": "string"},
+				})
+			}
+		}
+		for _, parameter := range r.operation.parameters {
+			parameters = append(parameters, map[string]interface{}{
+				"name":        parameter.name,
+				"in":          parameter.in,
+				"description": parameter.description,
+				"schema":      map[string]interface{}{"type": parameter.typ},
+			})
+		}
+		responses := map[string]interface{}{"default": errorResponse}
+		for _, status := range r.operation.statuses {
+			var body interface{}
+			if status != http.StatusNoContent {
+				body = r.operation.response
+			}
+			responses[strconv.Itoa(status)] = response(&schemas, status, body)
+		}
+		op := map[string]interface{}{
+			"operationId": r.operation.id,
+			"summary":     r.operation.summary,
+			"responses":   responses,
+		}
+		if len(parameters) > 0 {
+			op["parameters"] = parameters
+		}
+		if r.operation.request != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  content(&schemas, r.operation.request),
+			}
+		}
+		switch r.operation.auth {
+		case authRequired:
+			op["security"] = []interface{}{
+				map[string]interface{}{"bearer": []string{}},
+				map[string]interface{}{"signature": []string{}},
+			}
+		case authToken:
+			op["security"] = []interface{}{
+				map[string]interface{}{"bearer": []string{}},
+			}
+		}
+		p := strings.Join(segments, "/")
+		if paths[p] == nil {
+			paths[p] = map[string]interface{}{}
+		}
+		paths[p][strings.ToLower(r.method)] = op
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Codius Services API",
+			"version": v1alpha1.GroupVersion.Version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas.schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+				"signature": map[string]interface{}{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        "Signature",
+					"description": "An HTTP message signature by one of the service's Ed25519 owner keys",
+				},
+			},
+		},
+	}
+}
+
+func response(schemas *schemaGenerator, status int, body interface{}) map[string]interface{} {
+	resp := map[string]interface{}{"description": http.StatusText(status)}
+	if body != nil {
+		resp["content"] = content(schemas, body)
+	}
+	return resp
+}
+
+func content(schemas *schemaGenerator, body interface{}) map[string]interface{} {
+	if _, ok := body.(string); ok {
+		return map[string]interface{}{
+			"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+		}
+	}
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(body))},
+	}
+}
+
+// schemaGenerator generates OpenAPI schemas for Go types as encoded by
+// encoding/json, adding named structs to the document's component schemas
+type schemaGenerator struct {
+	schemas map[string]interface{}
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(metav1.Time{}), reflect.TypeOf(metav1.MicroTime{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(intstr.IntOrString{}):
+		return map[string]interface{}{
+			"oneOf": []interface{}{
+				map[string]interface{}{"type": "integer"},
+				map[string]interface{}{"type": "string"},
+			},
+		}
+	}
+	if t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(reflect.TypeOf((*json.Marshaler)(nil)).Elem()) {
+		// Custom encodings, such as of managed fields, are left undescribed
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name := schemaName(t)
+		if _, ok := g.schemas[name]; !ok {
+			// Reserve the name first, as structs may be recursive
+			g.schemas[name] = nil
+			g.schemas[name] = g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	g.addProperties(t, properties)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+func (g *schemaGenerator) addProperties(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		if field.Anonymous && tag[0] == "" {
+			// Embedded structs without a name are inlined
+			g.addProperties(field.Type, properties)
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.schema(field.Type)
+	}
+}
+
+// schemaName returns the component schema name of a struct, qualified by its
+// package
+func schemaName(t reflect.Type) string {
+	pkg := t.PkgPath()
+	if strings.HasPrefix(pkg, "github.com/codius/codius-operator/") {
+		return path.Base(pkg) + "." + t.Name()
+	}
+	return strings.Replace(pkg, "/", ".", -1) + "." + t.Name()
+}
@@ -17,96 +17,446 @@ limitations under the License.
 package servers
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/codius/codius-operator/api/v1alpha1"
+	"github.com/codius/codius-operator/certs"
+	"github.com/codius/codius-operator/payments"
 	"github.com/go-logr/logr"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+var (
+	// keepAliveInterval must be shorter than the reconciler's scale down delay
+	keepAliveInterval         = 30 * time.Second
+	connectionBillingInterval = time.Minute
+)
+
 type Proxy struct {
 	BindAddress string
+	// Address to serve TLS on, if Certificates is set
+	TLSBindAddress string
 	client.Client
 	Log logr.Logger
+	// Certificates provides certificates for TLS connections
+	Certificates *certs.Manager
+	// ACMEChallenges serves ACME http-01 challenge responses
+	ACMEChallenges http.Handler
+
+	backends  backendCache
+	usage     usageTracker
+	pages     *httputil.ReverseProxy
+	pagesOnce sync.Once
 }
 
 func (proxy *Proxy) Start(stopCh <-chan struct{}) error {
+	// Flush the usage of the last requests once the servers have shut down
+	defer proxy.flushUsage(context.Background())
 	svr := proxy.start()
 	defer proxy.stop(svr)
+	if proxy.Certificates != nil {
+		tlsSvr := proxy.startTLS()
+		defer proxy.stop(tlsSvr)
+	}
 
-	<-stopCh
+	proxy.reportUsage(stopCh)
 	return nil
 }
 
 func (proxy *Proxy) start() *http.Server {
-	http.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
-		proxy.Log.Info(req.Host)
-		serviceName := strings.SplitN(req.Host, ".", 2)[0]
-		ctx := req.Context()
-		var codiusService v1alpha1.Service
-		if err := proxy.Get(ctx, types.NamespacedName{Name: serviceName, Namespace: ""}, &codiusService); err != nil {
+	srv := &http.Server{
+		Addr:    proxy.BindAddress,
+		Handler: proxy.Handler(),
+		// No read or write timeouts, which would cut off long-lived
+		// WebSocket connections and gRPC streams
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			proxy.Log.Error(err, "Failed to run http server")
+		}
+	}()
+	return srv
+}
+
+func (proxy *Proxy) startTLS() *http.Server {
+	srv := &http.Server{
+		Addr:    proxy.TLSBindAddress,
+		Handler: proxy.Handler(),
+		TLSConfig: &tls.Config{
+			GetCertificate: proxy.Certificates.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	go func() {
+		if err := srv.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+			proxy.Log.Error(err, "Failed to run https server")
+		}
+	}()
+	return srv
+}
+
+// Handler returns the proxy's http.Handler. Cleartext HTTP/2 (h2c) is
+// accepted for gRPC clients.
+func (proxy *Proxy) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", chain(http.HandlerFunc(proxy.serveBackend),
+		withRequestID,
+		withRecovery(proxy.Log),
+		withAccessLog(proxy.Log),
+		withMetrics,
+		proxy.withService,
+		proxy.withRateLimit(newRateLimiter("PROXY_RATE_LIMIT", 0)),
+		proxy.withUsage,
+		proxy.withSuspension,
+		proxy.withAvailability,
+		proxy.withBilling,
+	))
+	if proxy.ACMEChallenges != nil {
+		mux.Handle("/.well-known/acme-challenge/", proxy.ACMEChallenges)
+	}
+	return h2c.NewHandler(mux, &http2.Server{
+		IdleTimeout: 2 * time.Minute,
+	})
+}
+
+// withService looks up the Codius service for the request host
+func (proxy *Proxy) withService(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		codiusService, err := proxy.serviceForHost(req.Context(), req.Host)
+		if err != nil {
+			proxy.Log.Error(err, "Failed to look up service", "host", req.Host)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if codiusService == nil {
 			rw.WriteHeader(http.StatusNotFound)
 			return
 		}
-		var proxyUrl string
-		if codiusService.Status.UnavailableReplicas > int32(0) && codiusService.Status.AvailableReplicas == int32(0) {
-			proxyUrl = fmt.Sprintf("%s/%s/503", os.Getenv("CODIUS_WEB_URL"), serviceName)
-		} else {
-			if err := deductBalance(&serviceName, os.Getenv("REQUEST_PRICE")); err != nil {
-				proxy.Log.Error(err, "Failed to spend balance")
-				proxyUrl = fmt.Sprintf("%s/%s/402", os.Getenv("CODIUS_WEB_URL"), serviceName)
-			} else {
-				service := &corev1.Service{
-					ObjectMeta: metav1.ObjectMeta{
-						Name:      codiusService.Labels["codius.org/service"],
-						Namespace: os.Getenv("CODIUS_NAMESPACE"),
-					},
-					Spec: corev1.ServiceSpec{},
-				}
-				mergePatch, err := json.Marshal(map[string]interface{}{
-					"metadata": map[string]interface{}{
-						"annotations": map[string]interface{}{
-							"codius.org/last-request-time": time.Now().Format(time.RFC3339),
-						},
-					},
-				})
-				if err != nil {
-					proxy.Log.Error(err, "Failed to marshal last request time patch")
-				}
-				if err := proxy.Patch(ctx, service, client.RawPatch(types.MergePatchType, mergePatch)); err != nil {
-					proxy.Log.Error(err, "unable to update last request time")
-				}
-				if codiusService.Status.AvailableReplicas > int32(0) {
-					proxyUrl = fmt.Sprintf("http://%s.%s", codiusService.Labels["codius.org/service"], os.Getenv("CODIUS_NAMESPACE"))
-				} else {
-					proxyUrl = fmt.Sprintf("%s/%s/503", os.Getenv("CODIUS_WEB_URL"), serviceName)
+		info := getRequestInfo(req.Context())
+		info.serviceName = codiusService.Name
+		info.codiusService = codiusService
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// serviceForHost returns the Codius service which has verified the host as a
+// custom domain or, for subdomains of CODIUS_HOSTNAME, the service named by
+// the first label of the host. It returns nil if there is no such service.
+func (proxy *Proxy) serviceForHost(ctx context.Context, host string) (*v1alpha1.Service, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var services v1alpha1.ServiceList
+	if err := proxy.List(ctx, &services, client.MatchingFields{v1alpha1.VerifiedDomainIndex: host}); err != nil {
+		return nil, err
+	}
+	// Only the service whose verification precedes the others' is served
+	var verified *v1alpha1.Service
+	for i := range services.Items {
+		if svc := &services.Items[i]; verified == nil || svc.DomainPrecedes(verified, host) {
+			for _, domain := range svc.VerifiedDomains() {
+				if domain == host {
+					verified = svc
 				}
 			}
 		}
-		url, _ := url.Parse(proxyUrl)
-		proxy := httputil.NewSingleHostReverseProxy(url)
-		proxy.ServeHTTP(rw, req)
+	}
+	if verified != nil {
+		return verified, nil
+	}
+
+	// Unverified custom domains must not fall through to a service with a
+	// matching name, which could then be served from the domain
+	hostname := os.Getenv("CODIUS_HOSTNAME")
+	if hostname != "" && !strings.HasSuffix(host, "."+hostname) {
+		return nil, nil
+	}
+	serviceName := strings.SplitN(host, ".", 2)[0]
+	var codiusService v1alpha1.Service
+	if err := proxy.Get(ctx, types.NamespacedName{Name: serviceName, Namespace: ""}, &codiusService); err != nil {
+		if apierrors.IsNotFound(err) {
+			proxy.backends.forget(serviceName)
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &codiusService, nil
+}
+
+// HostPolicy only allows certificates for hosts served by a Codius service
+func (proxy *Proxy) HostPolicy(ctx context.Context, host string) error {
+	codiusService, err := proxy.serviceForHost(ctx, host)
+	if err != nil {
+		return err
+	}
+	if codiusService == nil {
+		return fmt.Errorf("no service for host %s", host)
+	}
+	return nil
+}
+
+// withRateLimit serves the 429 page for requests exceeding the service's rate
+// limit, without billing them
+func (proxy *Proxy) withRateLimit(limiter *rateLimiter) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			serviceName := getRequestInfo(req.Context()).serviceName
+			if ok, delay := limiter.allow(serviceName); !ok {
+				setRetryAfter(rw, delay)
+				proxy.servePage(rw, req, serviceName, http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// withSuspension serves the 402 page for suspended services without charging
+// or recording the request, so they aren't scaled up until topped up
+func (proxy *Proxy) withSuspension(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		info := getRequestInfo(req.Context())
+		if info.codiusService.Status.Suspended {
+			proxy.servePage(rw, req, info.serviceName, http.StatusPaymentRequired)
+			return
+		}
+		next.ServeHTTP(rw, req)
 	})
-	srv := &http.Server{
-		Addr: proxy.BindAddress,
+}
+
+// withAvailability serves the 503 page without charging if the service's
+// pods are failing to become available
+func (proxy *Proxy) withAvailability(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		info := getRequestInfo(req.Context())
+		if info.codiusService.Status.UnavailableReplicas > int32(0) && info.codiusService.Status.AvailableReplicas == int32(0) {
+			proxy.servePage(rw, req, info.serviceName, http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// withBilling charges REQUEST_PRICE, or CONNECTION_PRICE for WebSocket
+// upgrades and gRPC streams, serving the 402 page if the balance can't be
+// spent, or the 503 page if the payment backend is unavailable. Paid requests
+// record the last request time so the service is scaled up.
+func (proxy *Proxy) withBilling(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		info := getRequestInfo(req.Context())
+		price := os.Getenv("REQUEST_PRICE")
+		if isLongLived(req, info.codiusService) {
+			price = connectionPrice()
+		}
+		if err := payments.Spend(req.Context(), info.serviceName, price); err != nil {
+			proxy.Log.Error(err, "Failed to spend balance", "id", info.id)
+			if errors.Is(err, payments.ErrUnavailable) {
+				proxy.servePage(rw, req, info.serviceName, http.StatusServiceUnavailable)
+			} else {
+				proxy.servePage(rw, req, info.serviceName, http.StatusPaymentRequired)
+			}
+			return
+		}
+		proxy.usage.add(info.serviceName, usage{billed: parseAmount(price)})
+		proxy.touch(req.Context(), info.codiusService)
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// serveBackend proxies the request to the service's pods
+func (proxy *Proxy) serveBackend(rw http.ResponseWriter, req *http.Request) {
+	info := getRequestInfo(req.Context())
+	if info.codiusService.Status.AvailableReplicas == int32(0) {
+		proxy.servePage(rw, req, info.serviceName, http.StatusServiceUnavailable)
+		return
 	}
-	go func() {
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			proxy.Log.Error(err, "Failed to run http server")
+	port := info.codiusService.Spec.PortForPath(req.URL.Path)
+	backend, err := proxy.backends.get(info.serviceName, port, backendUrl(info.codiusService, port), proxy.backendErrorHandler(info.serviceName))
+	if err != nil {
+		proxy.Log.Error(err, "Failed to create backend proxy", "Service.Name", info.serviceName)
+		proxy.servePage(rw, req, info.serviceName, http.StatusBadGateway)
+		return
+	}
+	if isLongLived(req, info.codiusService) {
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		// Keep long-lived connections and streams alive and paid for
+		go proxy.keepAlive(ctx, cancel, info.codiusService, info.serviceName)
+		req = req.WithContext(ctx)
+	}
+	info.inbound = req
+	backend.ServeHTTP(rw, req)
+}
+
+// servePage proxies the request to the Codius web page for the status code
+func (proxy *Proxy) servePage(rw http.ResponseWriter, req *http.Request, serviceName string, code int) {
+	proxyPagesTotal.WithLabelValues(serviceName, strconv.Itoa(code)).Inc()
+	proxy.pagesOnce.Do(func() {
+		target, err := url.Parse(os.Getenv("CODIUS_WEB_URL"))
+		if err != nil {
+			proxy.Log.Error(err, "Failed to parse Codius web url")
+			return
 		}
-	}()
-	return srv
+		proxy.pages = httputil.NewSingleHostReverseProxy(target)
+		proxy.pages.Transport = backendTransport
+	})
+	if proxy.pages == nil {
+		rw.WriteHeader(code)
+		return
+	}
+	req.URL.Path = fmt.Sprintf("/%s/%d%s", serviceName, code, req.URL.Path)
+	req.URL.RawPath = ""
+	proxy.pages.ServeHTTP(rw, req)
+}
+
+// backendErrorHandler serves the 503 page if the service's pods can't be
+// reached and the 502 page for any other proxy error. Pages are requested
+// with the inbound request, rather than the one rewritten for the backend, so
+// that they aren't forwarded twice.
+func (proxy *Proxy) backendErrorHandler(serviceName string) func(http.ResponseWriter, *http.Request, error) {
+	return func(rw http.ResponseWriter, req *http.Request, err error) {
+		if req.Context().Err() != nil {
+			// The client went away
+			return
+		}
+		if inbound := getRequestInfo(req.Context()).inbound; inbound != nil {
+			req = inbound
+		}
+		proxy.Log.Error(err, "Failed to proxy request", "Service.Name", serviceName)
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			proxy.servePage(rw, req, serviceName, http.StatusServiceUnavailable)
+		} else {
+			proxy.servePage(rw, req, serviceName, http.StatusBadGateway)
+		}
+	}
+}
+
+// touch records the current time as the last request time of the service's
+// Kubernetes Service, from which the reconciler decides when to scale down
+func (proxy *Proxy) touch(ctx context.Context, codiusService *v1alpha1.Service) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      codiusService.Labels["codius.org/service"],
+			Namespace: os.Getenv("CODIUS_NAMESPACE"),
+		},
+		Spec: corev1.ServiceSpec{},
+	}
+	mergePatch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				"codius.org/last-request-time": time.Now().Format(time.RFC3339),
+			},
+		},
+	})
+	if err != nil {
+		proxy.Log.Error(err, "Failed to marshal last request time patch")
+	}
+	if err := proxy.Patch(ctx, service, client.RawPatch(types.MergePatchType, mergePatch)); err != nil {
+		proxy.Log.Error(err, "unable to update last request time")
+	}
+}
+
+// keepAlive refreshes the last request time of the service for as long as the
+// request is in flight, so long-lived WebSocket connections and gRPC streams
+// aren't scaled down. They're charged CONNECTION_PRICE per minute and closed
+// once the balance runs out.
+func (proxy *Proxy) keepAlive(ctx context.Context, cancel context.CancelFunc, codiusService *v1alpha1.Service, serviceName string) {
+	touchTicker := time.NewTicker(keepAliveInterval)
+	defer touchTicker.Stop()
+	billTicker := time.NewTicker(connectionBillingInterval)
+	defer billTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-touchTicker.C:
+			proxy.touch(ctx, codiusService)
+		case <-billTicker.C:
+			price := connectionPrice()
+			if parseAmount(price) == 0 {
+				// Connections are free
+				continue
+			}
+			if err := payments.Spend(ctx, serviceName, price); errors.Is(err, payments.ErrUnavailable) {
+				// Don't cut off connections while the payment backend is down
+				proxy.Log.Error(err, "Failed to spend balance", "Service.Name", serviceName)
+				continue
+			} else if err != nil {
+				proxy.Log.Error(err, "Failed to spend balance, closing connection", "Service.Name", serviceName)
+				cancel()
+				return
+			}
+			proxy.usage.add(serviceName, usage{billed: parseAmount(price)})
+		}
+	}
+}
+
+// connectionPrice returns CONNECTION_PRICE, defaulting to REQUEST_PRICE
+func connectionPrice() string {
+	if price := os.Getenv("CONNECTION_PRICE"); price != "" {
+		return price
+	}
+	return os.Getenv("REQUEST_PRICE")
+}
+
+// isLongLived reports whether the request opens a WebSocket connection or a
+// gRPC stream, which may stay open indefinitely
+func isLongLived(req *http.Request, codiusService *v1alpha1.Service) bool {
+	if isWebSocketUpgrade(req) {
+		return true
+	}
+	port := codiusService.Spec.PortForPath(req.URL.Path)
+	return port != nil && port.Protocol == v1alpha1.PortProtocolGRPC
+}
+
+// isWebSocketUpgrade reports whether the request asks to switch to the WebSocket protocol
+func isWebSocketUpgrade(req *http.Request) bool {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range req.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// backendUrl returns the url of the Kubernetes Service port, or the default port if nil
+func backendUrl(codiusService *v1alpha1.Service, port *v1alpha1.ServicePort) string {
+	if port != nil {
+		return fmt.Sprintf("http://%s.%s:%d", codiusService.Labels["codius.org/service"], os.Getenv("CODIUS_NAMESPACE"), port.Port)
+	}
+	return fmt.Sprintf("http://%s.%s", codiusService.Labels["codius.org/service"], os.Getenv("CODIUS_NAMESPACE"))
 }
 
 func (proxy *Proxy) stop(srv *http.Server) {
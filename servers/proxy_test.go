@@ -0,0 +1,483 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package servers
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/codius/codius-operator/api/v1alpha1"
+)
+
+// touchCounter counts the patches of services' last request times
+type touchCounter struct {
+	client.Client
+	mu      *sync.Mutex
+	touches *int
+}
+
+func (c touchCounter) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	c.mu.Lock()
+	*c.touches++
+	c.mu.Unlock()
+	return nil
+}
+
+var _ = Describe("Proxy", func() {
+	var (
+		web       *httptest.Server
+		verifier  *httptest.Server
+		mu        sync.Mutex
+		balance   bool
+		spends    int
+		forwarded []string
+		k8sClient client.Client
+		proxy     *Proxy
+		handler   http.Handler
+	)
+
+	BeforeEach(func() {
+		// The Codius web frontend echoes the requested page path
+		web = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			forwarded = req.Header["X-Forwarded-For"]
+			rw.Write([]byte(req.URL.Path))
+		}))
+		verifier = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !balance {
+				http.Error(rw, "insufficient balance", http.StatusPaymentRequired)
+				return
+			}
+			spends++
+		}))
+		os.Setenv("CODIUS_WEB_URL", web.URL)
+		os.Setenv("RECEIPT_VERIFIER_URL", verifier.URL)
+		os.Setenv("CODIUS_NAMESPACE", "codius.invalid")
+		os.Setenv("REQUEST_PRICE", "10")
+		balance = true
+		spends = 0
+
+		k8sClient = fake.NewFakeClientWithScheme(scheme, &v1alpha1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "hello",
+				Labels: map[string]string{
+					"codius.org/service": "svc-hello",
+				},
+			},
+			Status: v1alpha1.ServiceStatus{
+				AvailableReplicas: 1,
+			},
+		}, &v1alpha1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "suspended",
+				Labels: map[string]string{
+					"codius.org/service": "svc-suspended",
+				},
+			},
+			Status: v1alpha1.ServiceStatus{
+				AvailableReplicas: 1,
+				Suspended:         true,
+			},
+		})
+		proxy = &Proxy{
+			Client: k8sClient,
+			Log:    logf.Log.WithName("proxy"),
+		}
+	})
+
+	JustBeforeEach(func() {
+		handler = proxy.Handler()
+	})
+
+	AfterEach(func() {
+		web.Close()
+		verifier.Close()
+		os.Unsetenv("REQUEST_PRICE")
+		os.Unsetenv("PROXY_RATE_LIMIT")
+	})
+
+	get := func(host, path string) (*http.Response, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = host
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		resp := rw.Result()
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return resp, string(body)
+	}
+
+	It("can build more than one handler", func() {
+		Expect((&Proxy{Log: logf.Log}).Handler()).NotTo(BeNil())
+		Expect((&Proxy{Log: logf.Log}).Handler()).NotTo(BeNil())
+	})
+
+	It("responds 404 for unknown services", func() {
+		resp, _ := get("unknown.codius.example", "/")
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("tags responses with a request id", func() {
+		resp, _ := get("unknown.codius.example", "/")
+		Expect(resp.Header.Get("X-Request-Id")).NotTo(BeEmpty())
+	})
+
+	It("serves the 402 page when the balance can't be spent", func() {
+		balance = false
+		_, body := get("hello.codius.example", "/foo")
+		Expect(body).To(Equal("/hello/402/foo"))
+	})
+
+	It("serves the 503 page when the backend can't be reached", func() {
+		_, body := get("hello.codius.example", "/foo")
+		Expect(body).To(Equal("/hello/503/foo"))
+		// The page is requested as received, not as forwarded to the backend
+		Expect(forwarded).To(Equal([]string{"192.0.2.1"}))
+	})
+
+	It("serves the 402 page for suspended services without charging them", func() {
+		_, body := get("suspended.codius.example", "/foo")
+		Expect(body).To(Equal("/suspended/402/foo"))
+		Expect(spends).To(BeZero())
+	})
+
+	It("records the usage of requests", func() {
+		get("hello.codius.example", "/foo")
+		get("suspended.codius.example", "/foo")
+		proxy.flushUsage(context.Background())
+
+		var codiusService v1alpha1.Service
+		Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "hello"}, &codiusService)).To(Succeed())
+		Expect(codiusService.Status.Usage).NotTo(BeNil())
+		Expect(codiusService.Status.Usage.Requests).To(Equal(int64(1)))
+		Expect(codiusService.Status.Usage.Billed).To(Equal(int64(10)))
+		Expect(codiusService.Status.Usage.BytesOut).To(BeNumerically(">", 0))
+		// Suspended services' requests are counted, but not billed
+		Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "suspended"}, &codiusService)).To(Succeed())
+		Expect(codiusService.Status.Usage.Requests).To(Equal(int64(1)))
+		Expect(codiusService.Status.Usage.Billed).To(BeZero())
+
+		// Usage is only added once
+		proxy.flushUsage(context.Background())
+		Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "hello"}, &codiusService)).To(Succeed())
+		Expect(codiusService.Status.Usage.Requests).To(Equal(int64(1)))
+	})
+
+	Context("with a rate limit", func() {
+		BeforeEach(func() {
+			os.Setenv("PROXY_RATE_LIMIT", "1")
+		})
+
+		It("serves the 429 page for requests exceeding a service's limit without charging them", func() {
+			_, body := get("hello.codius.example", "/foo")
+			Expect(body).To(Equal("/hello/503/foo"))
+			resp, body := get("hello.codius.example", "/foo")
+			Expect(body).To(Equal("/hello/429/foo"))
+			Expect(resp.Header.Get("Retry-After")).To(Equal("1"))
+			Expect(spends).To(Equal(1))
+
+			// Services are limited separately
+			_, body = get("suspended.codius.example", "/foo")
+			Expect(body).To(Equal("/suspended/402/foo"))
+		})
+	})
+
+	Context("with a backend", func() {
+		var (
+			backend *httptest.Server
+			front   *httptest.Server
+			touches int
+		)
+
+		spent := func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return spends
+		}
+		touched := func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return touches
+		}
+
+		BeforeEach(func() {
+			// The backend echoes WebSocket messages and gRPC stream messages
+			mux := http.NewServeMux()
+			mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+				rw.Write([]byte("hello"))
+			})
+			mux.HandleFunc("/ws", func(rw http.ResponseWriter, req *http.Request) {
+				conn, buf, err := rw.(http.Hijacker).Hijack()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+				buf.Flush()
+				io.Copy(conn, buf)
+			})
+			mux.HandleFunc("/helloworld.Greeter/", func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusOK)
+				rw.(http.Flusher).Flush()
+				data := make([]byte, 1024)
+				for {
+					n, err := req.Body.Read(data)
+					rw.Write(data[:n])
+					rw.(http.Flusher).Flush()
+					if err != nil {
+						return
+					}
+				}
+			})
+			backend = httptest.NewServer(h2c.NewHandler(mux, &http2.Server{}))
+			dialBackend = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, backend.Listener.Addr().String())
+			}
+			keepAliveInterval = 20 * time.Millisecond
+			connectionBillingInterval = 50 * time.Millisecond
+
+			var codiusService v1alpha1.Service
+			Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "hello"}, &codiusService)).To(Succeed())
+			codiusService.Spec.Ports = []v1alpha1.ServicePort{
+				{Name: "grpc", Port: 9090, Protocol: v1alpha1.PortProtocolGRPC, PathPrefix: "/helloworld.Greeter"},
+			}
+			Expect(k8sClient.Update(context.Background(), &codiusService)).To(Succeed())
+			touches = 0
+			proxy.Client = touchCounter{k8sClient, &mu, &touches}
+		})
+
+		JustBeforeEach(func() {
+			front = httptest.NewServer(handler)
+		})
+
+		AfterEach(func() {
+			front.Close()
+			backend.Close()
+			dialBackend = backendDialer.DialContext
+			keepAliveInterval = 30 * time.Second
+			connectionBillingInterval = time.Minute
+		})
+
+		It("charges plain requests once without keeping the service alive", func() {
+			req, err := http.NewRequest("GET", front.URL+"/", nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Host = "hello.codius.example"
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal("hello"))
+
+			Consistently(spent, 150*time.Millisecond).Should(Equal(1))
+			Expect(touched()).To(Equal(1))
+		})
+
+		It("replaces cached backends once the service's backend changes", func() {
+			var dialed []string
+			dialBackend = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				mu.Lock()
+				dialed = append(dialed, addr)
+				mu.Unlock()
+				return (&net.Dialer{}).DialContext(ctx, network, backend.Listener.Addr().String())
+			}
+			request := func() string {
+				req, err := http.NewRequest("GET", front.URL+"/", nil)
+				ExpectWithOffset(1, err).NotTo(HaveOccurred())
+				req.Host = "hello.codius.example"
+				resp, err := http.DefaultClient.Do(req)
+				ExpectWithOffset(1, err).NotTo(HaveOccurred())
+				defer resp.Body.Close()
+				body, err := ioutil.ReadAll(resp.Body)
+				ExpectWithOffset(1, err).NotTo(HaveOccurred())
+				return string(body)
+			}
+			Expect(request()).To(Equal("hello"))
+			cached := proxy.backends.backends["hello"]
+			Expect(cached).NotTo(BeNil())
+			Expect(request()).To(Equal("hello"))
+			Expect(proxy.backends.backends["hello"]).To(BeIdenticalTo(cached))
+
+			var codiusService v1alpha1.Service
+			Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "hello"}, &codiusService)).To(Succeed())
+			codiusService.Labels["codius.org/service"] = "svc-replaced"
+			Expect(k8sClient.Update(context.Background(), &codiusService)).To(Succeed())
+			Expect(request()).To(Equal("hello"))
+			Expect(proxy.backends.backends["hello"]).NotTo(BeIdenticalTo(cached))
+			Expect(proxy.backends.backends["hello"].url).To(HavePrefix("http://svc-replaced."))
+			mu.Lock()
+			defer mu.Unlock()
+			Expect(dialed[len(dialed)-1]).To(HavePrefix("svc-replaced."))
+		})
+
+		It("forgets cached backends once the service is deleted", func() {
+			req, err := http.NewRequest("GET", front.URL+"/", nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Host = "hello.codius.example"
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(proxy.backends.backends).To(HaveKey("hello"))
+			proxy.backends.get("hello", &v1alpha1.ServicePort{Name: "grpc"}, "http://svc-hello:9090", nil)
+			proxy.backends.get("hello-world", nil, "http://svc-hello-world", nil)
+
+			var codiusService v1alpha1.Service
+			Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "hello"}, &codiusService)).To(Succeed())
+			Expect(k8sClient.Delete(context.Background(), &codiusService)).To(Succeed())
+			resp, err = http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+			Expect(proxy.backends.backends).NotTo(HaveKey("hello"))
+			Expect(proxy.backends.backends).NotTo(HaveKey("hello/grpc"))
+			Expect(proxy.backends.backends).To(HaveKey("hello-world"))
+		})
+
+		It("charges WebSocket connections per minute and keeps the service alive while they're open", func() {
+			conn, err := net.Dial("tcp", front.Listener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			_, err = conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: hello.codius.example\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+			Expect(err).NotTo(HaveOccurred())
+			reader := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(reader, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+
+			_, err = conn.Write([]byte("ping"))
+			Expect(err).NotTo(HaveOccurred())
+			data := make([]byte, 4)
+			_, err = io.ReadFull(reader, data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal("ping"))
+
+			// Charged when opened and every billing interval thereafter
+			Eventually(spent).Should(BeNumerically(">=", 3))
+			Eventually(touched).Should(BeNumerically(">=", 3))
+
+			conn.Close()
+			Eventually(func() int {
+				before := spent()
+				time.Sleep(2 * connectionBillingInterval)
+				return spent() - before
+			}).Should(BeZero())
+		})
+
+		It("closes WebSocket connections once the balance runs out", func() {
+			conn, err := net.Dial("tcp", front.Listener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			_, err = conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: hello.codius.example\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+			Expect(err).NotTo(HaveOccurred())
+			reader := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(reader, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+
+			mu.Lock()
+			balance = false
+			mu.Unlock()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err = reader.ReadByte()
+			Expect(err).To(Equal(io.EOF))
+		})
+
+		It("charges gRPC streams per minute and keeps the service alive while they're open", func() {
+			h2cClient := &http.Client{Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+					return net.Dial(network, addr)
+				},
+			}}
+			requestBody, stream := io.Pipe()
+			req, err := http.NewRequest("POST", front.URL+"/helloworld.Greeter/SayHello", requestBody)
+			Expect(err).NotTo(HaveOccurred())
+			req.Host = "hello.codius.example"
+			req.Header.Set("Content-Type", "application/grpc")
+			resp, err := h2cClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			_, err = stream.Write([]byte("ping"))
+			Expect(err).NotTo(HaveOccurred())
+			data := make([]byte, 4)
+			_, err = io.ReadFull(resp.Body, data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal("ping"))
+
+			Eventually(spent).Should(BeNumerically(">=", 3))
+			Eventually(touched).Should(BeNumerically(">=", 3))
+
+			stream.Close()
+			_, err = ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() int {
+				before := spent()
+				time.Sleep(2 * connectionBillingInterval)
+				return spent() - before
+			}).Should(BeZero())
+		})
+	})
+
+	It("serves custom domains from the service which verified them first", func() {
+		verified := func(name string, t time.Time) *v1alpha1.Service {
+			return &v1alpha1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				Status: v1alpha1.ServiceStatus{
+					Domains: []v1alpha1.DomainStatus{{
+						Name:         "example.com",
+						Verified:     true,
+						VerifiedTime: &metav1.Time{Time: t},
+					}},
+				},
+			}
+		}
+		now := time.Now()
+		proxy := &Proxy{
+			Client: fake.NewFakeClientWithScheme(scheme,
+				verified("a-later", now),
+				verified("b-earlier", now.Add(-time.Minute)),
+			),
+			Log: logf.Log.WithName("proxy"),
+		}
+		codiusService, err := proxy.serviceForHost(context.Background(), "example.com")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(codiusService.Name).To(Equal("b-earlier"))
+	})
+})
@@ -0,0 +1,114 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package servers
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterTTL is how long the rate limit of an idle key is remembered
+const rateLimiterTTL = 10 * time.Minute
+
+type keyLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter limits the rate of requests per key, such as per client IP, with
+// a token bucket for each key. A nil rateLimiter allows all requests.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	limiters  map[string]*keyLimiter
+	lastSweep time.Time
+}
+
+// newRateLimiter returns a rate limiter allowing the rate of requests per
+// second in the environment variable, or the default rate if it is unset.
+// Bursts of up to a second's worth of requests are allowed. Returns nil if the
+// rate is 0.
+func newRateLimiter(env string, defaultRate float64) *rateLimiter {
+	perSecond := defaultRate
+	if value, ok := os.LookupEnv(env); ok {
+		perSecond, _ = strconv.ParseFloat(value, 64)
+	}
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		limit:    rate.Limit(perSecond),
+		burst:    int(math.Ceil(perSecond)),
+		limiters: map[string]*keyLimiter{},
+	}
+}
+
+// allow reports whether a request for the key is allowed now, or otherwise
+// how long until it would be
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	if now.Sub(l.lastSweep) > rateLimiterTTL {
+		for k, limiter := range l.limiters {
+			if now.Sub(limiter.lastSeen) > rateLimiterTTL {
+				delete(l.limiters, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	limiter, ok := l.limiters[key]
+	if !ok {
+		limiter = &keyLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = limiter
+	}
+	limiter.lastSeen = now
+	l.mu.Unlock()
+
+	reservation := limiter.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// setRetryAfter sets the Retry-After header of a rate limited response
+func setRetryAfter(rw http.ResponseWriter, delay time.Duration) {
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+}
+
+// clientIP returns the IP address of the client. Forwarding headers aren't
+// trusted, as they may be set by the client.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
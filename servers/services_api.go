@@ -17,91 +17,181 @@ limitations under the License.
 package servers
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/codius/codius-operator/api/v1alpha1"
+	"github.com/codius/codius-operator/payments"
+	"github.com/codius/codius-operator/servicesapi"
 	"github.com/go-logr/logr"
+	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
 	"github.com/rs/cors"
 
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+const (
+	// maxReceiptSize is the maximum size of a base64 encoded STREAM receipt
+	maxReceiptSize = 1024
+	// maxRequestSize is the maximum size of a request body, such as a service
+	maxRequestSize = 1 << 20
+	// defaultListLimit and maxListLimit bound the services returned per page
+	defaultListLimit = 100
+	maxListLimit     = 500
+)
+
 type ServicesApi struct {
 	BindAddress string
 	client.Client
-	Log logr.Logger
-}
+	// APIReader reads from the API server rather than the cache, so that
+	// lists of services are paginated and ETags are current. Defaults to
+	// the Client.
+	APIReader client.Reader
+	Log       logr.Logger
 
-type Service struct {
-	Spec       v1alpha1.ServiceSpec
-	SecretData map[string]string
+	// ownerLimiter limits the rate of authenticated requests per owner
+	ownerLimiter *rateLimiter
+	// signatures are those of recent signed requests, which can't be replayed
+	signatures *signatureCache
 }
 
 func (api *ServicesApi) createOrReplaceService() httprouter.Handle {
 	return func(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-		authHeader := req.Header.Get("Authorization")
-		if authHeader == "" {
-			rw.WriteHeader(http.StatusUnauthorized)
+		owner, ok := api.authenticate(rw, req)
+		if !ok {
 			return
 		}
-		authHeaderParts := strings.Fields(authHeader)
-		if len(authHeaderParts) != 2 || strings.ToLower(authHeaderParts[0]) != "bearer" {
-			http.Error(rw, "Authorization header format must be Bearer {token}", http.StatusUnauthorized)
-			return
-		}
-		token := authHeaderParts[1]
 		name := ps.ByName("name")
-		var service Service
+		var service servicesapi.Service
 		dec := json.NewDecoder(req.Body)
 		dec.DisallowUnknownFields()
 		if err := dec.Decode(&service); err != nil {
 			api.Log.Error(err, "Failed to decode service", "Service.Name", name)
-			rw.WriteHeader(http.StatusBadRequest)
+			writeError(rw, http.StatusBadRequest, "Invalid service: "+err.Error())
 			return
 		}
-		if err := deductBalance(&token, os.Getenv("SERVICE_PRICE")); err != nil {
-			api.Log.Error(err, "Failed to spend balance", "Service.Name", name)
-			rw.WriteHeader(http.StatusPaymentRequired)
+		if owner.keyID != "" && !containsString(service.OwnerKeys, owner.keyID) {
+			// Signers mustn't lock themselves out, and prove possession of a new key
+			writeError(rw, http.StatusBadRequest, "OwnerKeys must include the signing key")
 			return
 		}
 		ctx := req.Context()
+		var existing *v1alpha1.Service
+		var current v1alpha1.Service
+		// Read from the API server so that preconditions aren't checked against a stale cache
+		if err := api.reader().Get(ctx, types.NamespacedName{Name: name, Namespace: ""}, &current); err == nil {
+			if !owner.owns(&current) {
+				writeError(rw, http.StatusForbidden, notOwnerMessage)
+				return
+			}
+			existing = &current
+		} else if !apierrors.IsNotFound(err) {
+			api.Log.Error(err, "Failed to get Service", "Service.Name", name)
+			writeError(rw, http.StatusInternalServerError, "")
+			return
+		}
+		ifMatch := req.Header.Get("If-Match")
+		ifNoneMatch := req.Header.Get("If-None-Match")
+		if existing == nil && ifMatch != "" {
+			writeError(rw, http.StatusPreconditionFailed, "Service does not exist")
+			return
+		}
+		if existing != nil && ifMatch != "" && !matchesETag(ifMatch, etag(existing)) {
+			writeError(rw, http.StatusPreconditionFailed, "Service has been modified")
+			return
+		}
+		if existing != nil && ifNoneMatch != "" && matchesETag(ifNoneMatch, etag(existing)) {
+			writeError(rw, http.StatusPreconditionFailed, "Service already exists")
+			return
+		}
+		labels, annotations, err := owners(existing, owner, service.OwnerKeys)
+		if err != nil {
+			api.Log.Error(err, "Failed to record owners", "Service.Name", name)
+			writeError(rw, http.StatusInternalServerError, "")
+			return
+		}
 		codiusService := v1alpha1.Service{
 			TypeMeta: metav1.TypeMeta{
 				APIVersion: v1alpha1.GroupVersion.String(),
 				Kind:       "Service",
 			},
 			ObjectMeta: metav1.ObjectMeta{
-				Name: name,
-				Labels: map[string]string{
-					"codius.org/immutable": "false",
-					"codius.org/token":     token,
-				},
+				Name:        name,
+				Labels:      labels,
+				Annotations: annotations,
 			},
 			Spec:       service.Spec,
 			SecretData: service.SecretData,
+			Domains:    service.Domains,
+			AlwaysOn:   service.AlwaysOn,
 		}
-		// Create or replace
-		if err := api.Patch(ctx, &codiusService, client.Apply, client.ForceOwnership, client.FieldOwner("manager")); err != nil {
+		// Validate with a dry run so rejected services aren't charged for
+		if err := api.Patch(ctx, codiusService.DeepCopy(), client.Apply, client.ForceOwnership, client.FieldOwner("manager"), client.DryRunAll); err != nil {
+			api.Log.Error(err, "Failed to validate Service.", "Service.Name", name)
+			writeAPIError(rw, err)
+			return
+		}
+		price := os.Getenv("SERVICE_PRICE")
+		if err := payments.Spend(ctx, owner.account(), price); err != nil {
+			api.Log.Error(err, "Failed to spend balance", "Service.Name", name)
+			writePaymentError(rw, err)
+			return
+		}
+		if existing != nil && ifMatch != "" && ifMatch != "*" {
+			// The API server rejects the apply if the service has since been modified
+			codiusService.ResourceVersion = existing.ResourceVersion
+		}
+		if existing == nil && ifNoneMatch == "*" {
+			// Create only, failing if the service has since been created
+			err = api.Create(ctx, &codiusService, client.FieldOwner("manager"))
+		} else {
+			// Create or replace
+			err = api.applyService(ctx, &codiusService, ifMatch)
+		}
+		if err != nil {
 			api.Log.Error(err, "Failed to patch Service.", "Service.Name", name)
-			if strings.Contains(err.Error(), "is forbidden") {
-				rw.WriteHeader(http.StatusForbidden)
-			} else if strings.Contains(err.Error(), "is invalid") {
-				rw.WriteHeader(http.StatusBadRequest)
+			// The request may have been cancelled, but the refund must still be made
+			if err := payments.Refund(context.Background(), owner.account(), price); err != nil {
+				api.Log.Error(err, "Failed to refund balance", "Service.Name", name, "amount", price)
+				if err := api.recordFailedRefund(context.Background(), name, owner, price); err != nil {
+					api.Log.Error(err, "Failed to record refund", "Service.Name", name, "amount", price)
+				}
+			}
+			if (ifMatch != "" && apierrors.IsConflict(err)) || (ifNoneMatch != "" && apierrors.IsAlreadyExists(err)) {
+				writeError(rw, http.StatusPreconditionFailed, "Service has been modified")
 			} else {
-				rw.WriteHeader(http.StatusInternalServerError)
+				writeAPIError(rw, err)
 			}
 			return
 		}
-		if codiusService.Generation == 1 {
-			rw.WriteHeader(http.StatusCreated)
+		rw.Header().Set("ETag", etag(&codiusService))
+		rw.Header().Set("Location", "/services/"+url.PathEscape(name))
+		// The service was created if it didn't exist, or was deleted and recreated since
+		if existing == nil || existing.UID != codiusService.UID {
+			apiServicesTotal.WithLabelValues("create").Inc()
+			writeJSON(rw, http.StatusCreated, codiusService.Sanitize())
 		} else {
-			rw.WriteHeader(http.StatusNoContent)
+			apiServicesTotal.WithLabelValues("replace").Inc()
+			writeJSON(rw, http.StatusOK, codiusService.Sanitize())
 		}
 	}
 }
@@ -110,21 +200,519 @@ func (api *ServicesApi) getService() httprouter.Handle {
 	return func(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 		ctx := req.Context()
 		var codiusService v1alpha1.Service
-		if err := api.Get(ctx, types.NamespacedName{Name: ps.ByName("name"), Namespace: ""}, &codiusService); err != nil {
-			rw.WriteHeader(http.StatusNotFound)
+		// Read from the API server, as replacing does, so that the ETag isn't stale
+		if err := api.reader().Get(ctx, types.NamespacedName{Name: ps.ByName("name"), Namespace: ""}, &codiusService); err != nil {
+			writeAPIError(rw, err)
 			return
 		}
 		data, err := json.Marshal(codiusService.Sanitize())
 		if err != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
+			writeError(rw, http.StatusInternalServerError, "")
 			return
 		}
+		rw.Header().Set("ETag", etag(&codiusService))
 		rw.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		rw.WriteHeader(http.StatusOK)
 		rw.Write(data)
 	}
 }
 
+// listServices lists the requester's services, optionally filtered by label
+// selector. Immutable services have no owners, so only mutable services are
+// listed.
+func (api *ServicesApi) listServices() httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		query := req.URL.Query()
+		selector, err := labels.Parse(query.Get("labelSelector"))
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, "Invalid labelSelector: "+err.Error())
+			return
+		}
+		owner, ok := api.authenticate(rw, req)
+		if !ok {
+			return
+		}
+		ownerLabel, err := v1alpha1.OwnerLabel(owner.account())
+		if err != nil {
+			api.Log.Error(err, "Failed to label owner")
+			writeError(rw, http.StatusInternalServerError, "")
+			return
+		}
+		requirement, err := labels.NewRequirement(ownerLabel, selection.Equals, []string{"true"})
+		if err != nil {
+			writeError(rw, http.StatusInternalServerError, "")
+			return
+		}
+		selector = selector.Add(*requirement)
+		limit := int64(defaultListLimit)
+		if value := query.Get("limit"); value != "" {
+			limit, err = strconv.ParseInt(value, 10, 64)
+			if err != nil || limit <= 0 {
+				writeError(rw, http.StatusBadRequest, "limit must be a positive integer")
+				return
+			}
+			if limit > maxListLimit {
+				limit = maxListLimit
+			}
+		}
+
+		var codiusServices v1alpha1.ServiceList
+		if err := api.reader().List(req.Context(), &codiusServices,
+			client.MatchingLabelsSelector{Selector: selector},
+			client.Limit(limit),
+			client.Continue(query.Get("continue")),
+		); err != nil {
+			api.Log.Error(err, "Failed to list Services")
+			writeAPIError(rw, err)
+			return
+		}
+		list := servicesapi.ServiceList{
+			Items:    make([]*v1alpha1.Service, len(codiusServices.Items)),
+			Continue: codiusServices.Continue,
+		}
+		for i := range codiusServices.Items {
+			list.Items[i] = codiusServices.Items[i].Sanitize()
+		}
+		writeJSON(rw, http.StatusOK, list)
+	}
+}
+
+func (api *ServicesApi) deleteService() httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		codiusService, ok := api.authorizedService(rw, req, ps.ByName("name"))
+		if !ok {
+			return
+		}
+		if err := api.Delete(req.Context(), codiusService); err != nil {
+			api.Log.Error(err, "Failed to delete Service", "Service.Name", codiusService.Name)
+			writeAPIError(rw, err)
+			return
+		}
+		apiServicesTotal.WithLabelValues("delete").Inc()
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (api *ServicesApi) getServiceUsage() httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		codiusService, ok := api.authorizedService(rw, req, ps.ByName("name"))
+		if !ok {
+			return
+		}
+		usage := codiusService.Status.Usage
+		if usage == nil {
+			usage = &v1alpha1.ServiceUsage{}
+		}
+		writeJSON(rw, http.StatusOK, usage)
+	}
+}
+
+func (api *ServicesApi) getServiceBalance() httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		codiusService, ok := api.authorizedService(rw, req, ps.ByName("name"))
+		if !ok {
+			return
+		}
+		amount, err := payments.Balance(req.Context(), codiusService.Name)
+		if err != nil {
+			api.Log.Error(err, "Failed to get balance", "Service.Name", codiusService.Name)
+			writePaymentError(rw, err)
+			return
+		}
+		writeJSON(rw, http.StatusOK, servicesapi.Balance{Balance: amount})
+	}
+}
+
+// topUpServiceBalance credits the STREAM receipt in the request body to the
+// service's balance. Anyone may top up a service.
+func (api *ServicesApi) topUpServiceBalance() httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		name := ps.ByName("name")
+		var codiusService v1alpha1.Service
+		if err := api.Get(req.Context(), types.NamespacedName{Name: name, Namespace: ""}, &codiusService); err != nil {
+			writeAPIError(rw, err)
+			return
+		}
+		receipt, err := ioutil.ReadAll(io.LimitReader(req.Body, maxReceiptSize))
+		if err != nil || len(receipt) == 0 {
+			writeError(rw, http.StatusBadRequest, "Request body must be a receipt")
+			return
+		}
+		amount, err := payments.CreditReceipt(req.Context(), name, strings.TrimSpace(string(receipt)))
+		if err != nil {
+			api.Log.Error(err, "Failed to credit receipt", "Service.Name", name)
+			var paymentErr *payments.Error
+			if errors.As(err, &paymentErr) && paymentErr.StatusCode < 500 {
+				writeError(rw, http.StatusBadRequest, "Invalid receipt")
+			} else {
+				writePaymentError(rw, err)
+			}
+			return
+		}
+		if codiusService.Status.Suspended && amount > 0 {
+			// Resume the service now rather than when its balance is next polled
+			codiusService.Status.Balance = &amount
+			codiusService.Status.Suspended = false
+			if err := api.Status().Update(req.Context(), &codiusService); err != nil {
+				api.Log.Error(err, "Failed to resume Service", "Service.Name", name)
+			}
+		}
+		writeJSON(rw, http.StatusOK, servicesapi.Balance{Balance: amount})
+	}
+}
+
+// recordFailedRefund records a refund which couldn't be made in a Secret, as
+// the account may be a token, so that it can be reconciled with the receipt
+// verifier
+func (api *ServicesApi) recordFailedRefund(ctx context.Context, name string, o owner, amount string) error {
+	failedRefundsTotal.Inc()
+	secret := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "refund-" + uuid.New().String(),
+			Namespace: os.Getenv("CODIUS_NAMESPACE"),
+			Labels: map[string]string{
+				"codius.org/refund": "failed",
+			},
+			Annotations: map[string]string{
+				"codius.org/service":     name,
+				"codius.org/refund-time": time.Now().Format(time.RFC3339),
+			},
+		},
+		Data: map[string][]byte{
+			"account": []byte(o.account()),
+			"amount":  []byte(amount),
+		},
+	}
+	return api.Create(ctx, &secret)
+}
+
+// applyService creates or replaces the service. If it must match the If-Match
+// header, the apply is retried if it conflicts with status updates which
+// haven't changed the service's entity tag.
+func (api *ServicesApi) applyService(ctx context.Context, codiusService *v1alpha1.Service, ifMatch string) error {
+	for attempt := 1; ; attempt++ {
+		err := api.Patch(ctx, codiusService, client.Apply, client.ForceOwnership, client.FieldOwner("manager"))
+		if !apierrors.IsConflict(err) || codiusService.ResourceVersion == "" || attempt == 3 {
+			return err
+		}
+		var current v1alpha1.Service
+		if getErr := api.reader().Get(ctx, types.NamespacedName{Name: codiusService.Name}, &current); getErr != nil || !matchesETag(ifMatch, etag(&current)) {
+			return err
+		}
+		codiusService.ResourceVersion = current.ResourceVersion
+	}
+}
+
+// reader returns the APIReader, or the Client if there is none
+func (api *ServicesApi) reader() client.Reader {
+	if api.APIReader == nil {
+		return api.Client
+	}
+	return api.APIReader
+}
+
+// etag returns the entity tag of a service, a hash of the fields which
+// replacing it sets, so that it isn't changed by status updates. Secret data
+// is covered by the generation rather than hashed, so that it can't be
+// guessed from the tag.
+func etag(codiusService *v1alpha1.Service) string {
+	data, err := json.Marshal(struct {
+		Generation  int64
+		Labels      map[string]string
+		Annotations map[string]string
+		Spec        v1alpha1.ServiceSpec
+		Domains     []string
+		AlwaysOn    bool
+	}{
+		Generation:  codiusService.Generation,
+		Labels:      codiusService.Labels,
+		Annotations: codiusService.Annotations,
+		Spec:        codiusService.Spec,
+		Domains:     codiusService.Domains,
+		AlwaysOn:    codiusService.AlwaysOn,
+	})
+	if err != nil {
+		// Never matches
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// matchesETag reports whether an If-Match or If-None-Match header matches
+// the entity tag. Weak tags never match.
+func matchesETag(header, tag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	rw.WriteHeader(status)
+	rw.Write(data)
+}
+
+// notOwnerMessage is the message of responses to requests which neither bear the
+// service's token nor are signed by one of its owner keys
+const notOwnerMessage = "Request is not authorized to manage the service"
+
+// authorizedService returns the Codius service if the request bears its
+// token or is signed by one of its owner keys, otherwise responding with the
+// appropriate error
+func (api *ServicesApi) authorizedService(rw http.ResponseWriter, req *http.Request, name string) (*v1alpha1.Service, bool) {
+	owner, ok := api.authenticate(rw, req)
+	if !ok {
+		return nil, false
+	}
+	var codiusService v1alpha1.Service
+	if err := api.Get(req.Context(), types.NamespacedName{Name: name, Namespace: ""}, &codiusService); err != nil {
+		writeAPIError(rw, err)
+		return nil, false
+	}
+	if !owner.owns(&codiusService) {
+		writeError(rw, http.StatusForbidden, notOwnerMessage)
+		return nil, false
+	}
+	return &codiusService, true
+}
+
+// owner identifies the requester managing a service, by either a bearer
+// token or the owner key with which the request was signed
+type owner struct {
+	token string
+	keyID string
+}
+
+// authenticate returns the owner making the request, otherwise responding
+// with the appropriate error. Requests are rate limited per owner once
+// authenticated, so that others can't exhaust an owner's limit by claiming to
+// be them.
+func (api *ServicesApi) authenticate(rw http.ResponseWriter, req *http.Request) (owner, bool) {
+	owner, err := requestOwner(req)
+	if err != nil {
+		writeError(rw, http.StatusUnauthorized, err.Error())
+		return owner, false
+	}
+	if owner.keyID != "" && !api.signatures.add(owner.keyID, parseSignature(req.Header.Get("Signature"))["signature"], time.Now()) {
+		writeError(rw, http.StatusUnauthorized, "Signature has already been used")
+		return owner, false
+	}
+	if ok, delay := api.ownerLimiter.allow(owner.account()); !ok {
+		setRetryAfter(rw, delay)
+		writeError(rw, http.StatusTooManyRequests, "Rate limit exceeded")
+		return owner, false
+	}
+	return owner, true
+}
+
+// requestOwner authenticates the request by its Signature header if it has
+// one, otherwise by its bearer token
+func requestOwner(req *http.Request) (owner, error) {
+	if req.Header.Get("Signature") == "" {
+		token, err := bearerToken(req)
+		return owner{token: token}, err
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return owner{}, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	keyID, err := verifySignature(req, body, time.Now())
+	return owner{keyID: keyID}, err
+}
+
+// owns reports whether the owner may manage the service
+func (o owner) owns(codiusService *v1alpha1.Service) bool {
+	if o.keyID != "" {
+		return codiusService.HasOwnerKey(o.keyID)
+	}
+	return codiusService.HasToken(o.token)
+}
+
+// account returns the balance from which the owner pays
+func (o owner) account() string {
+	if o.keyID != "" {
+		return o.keyID
+	}
+	return o.token
+}
+
+// owners returns the labels and annotations recording the owners of a
+// service being created or replaced. The token of an existing service is
+// kept, and a new token is hashed.
+func owners(existing *v1alpha1.Service, o owner, ownerKeys []string) (map[string]string, map[string]string, error) {
+	// The requester pays for the service, so it counts towards their quota
+	account, err := v1alpha1.AccountLabelValue(o.account())
+	if err != nil {
+		return nil, nil, err
+	}
+	labels := map[string]string{
+		"codius.org/immutable": "false",
+		v1alpha1.AccountLabel:  account,
+	}
+	annotations := map[string]string{}
+	if len(ownerKeys) > 0 {
+		annotations[v1alpha1.OwnerKeysAnnotation] = strings.Join(ownerKeys, ",")
+	}
+	for _, key := range ownerKeys {
+		label, err := v1alpha1.OwnerLabel(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		labels[label] = "true"
+	}
+	token := o.token
+	if existing != nil {
+		if token == "" {
+			// Keep the label of the existing token, which signed requests don't know
+			tokenLabels, err := tokenOwnerLabels(existing)
+			if err != nil {
+				return nil, nil, err
+			}
+			for label := range tokenLabels {
+				labels[label] = "true"
+			}
+		}
+		if hash, ok := existing.Annotations[v1alpha1.TokenHashAnnotation]; ok {
+			annotations[v1alpha1.TokenHashAnnotation] = hash
+			token = ""
+		} else if legacy, ok := existing.Labels["codius.org/token"]; ok {
+			// Migrate the legacy token label to a hash
+			token = legacy
+		}
+	}
+	if token != "" {
+		hash, err := v1alpha1.HashToken(token)
+		if err != nil {
+			return nil, nil, err
+		}
+		annotations[v1alpha1.TokenHashAnnotation] = hash
+	}
+	if o.token != "" {
+		token = o.token
+	}
+	if token != "" {
+		label, err := v1alpha1.OwnerLabel(token)
+		if err != nil {
+			return nil, nil, err
+		}
+		labels[label] = "true"
+	}
+	return labels, annotations, nil
+}
+
+// tokenOwnerLabels returns the owner labels of the service which don't
+// identify one of its owner keys, and so identify its token
+func tokenOwnerLabels(codiusService *v1alpha1.Service) (map[string]bool, error) {
+	labels := map[string]bool{}
+	for label := range codiusService.Labels {
+		if strings.HasPrefix(label, v1alpha1.OwnerLabelPrefix) {
+			labels[label] = true
+		}
+	}
+	for _, key := range codiusService.OwnerKeys() {
+		label, err := v1alpha1.OwnerLabel(key)
+		if err != nil {
+			return nil, err
+		}
+		delete(labels, label)
+	}
+	return labels, nil
+}
+
+// rotateServiceToken replaces the service's token with the one in the
+// request body. Only the holder of the current token may rotate it.
+func (api *ServicesApi) rotateServiceToken() httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if req.Header.Get("Signature") != "" {
+			writeError(rw, http.StatusForbidden, "Tokens may only be rotated with the current token")
+			return
+		}
+		codiusService, ok := api.authorizedService(rw, req, ps.ByName("name"))
+		if !ok {
+			return
+		}
+		var rotation servicesapi.TokenRotation
+		dec := json.NewDecoder(req.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&rotation); err != nil || rotation.Token == "" {
+			writeError(rw, http.StatusBadRequest, "Request body must contain the new token")
+			return
+		}
+		tokenHash, err := v1alpha1.HashToken(rotation.Token)
+		if err != nil {
+			api.Log.Error(err, "Failed to hash token", "Service.Name", codiusService.Name)
+			writeError(rw, http.StatusInternalServerError, "")
+			return
+		}
+		// Authorize the change of the token hash to the validating webhook
+		mac, err := v1alpha1.TokenRotationMAC(codiusService.Name, codiusService.Annotations[v1alpha1.TokenHashAnnotation], tokenHash)
+		if err != nil {
+			api.Log.Error(err, "Failed to authorize token rotation", "Service.Name", codiusService.Name)
+			writeError(rw, http.StatusInternalServerError, "")
+			return
+		}
+		oldLabels, err := tokenOwnerLabels(codiusService)
+		if err != nil {
+			api.Log.Error(err, "Failed to label owner", "Service.Name", codiusService.Name)
+			writeError(rw, http.StatusInternalServerError, "")
+			return
+		}
+		newLabel, err := v1alpha1.OwnerLabel(rotation.Token)
+		if err != nil {
+			api.Log.Error(err, "Failed to label owner", "Service.Name", codiusService.Name)
+			writeError(rw, http.StatusInternalServerError, "")
+			return
+		}
+		patch := client.MergeFrom(codiusService.DeepCopy())
+		if codiusService.Annotations == nil {
+			codiusService.Annotations = map[string]string{}
+		}
+		codiusService.Annotations[v1alpha1.TokenRotationAnnotation] = mac
+		codiusService.Annotations[v1alpha1.TokenHashAnnotation] = tokenHash
+		delete(codiusService.Labels, "codius.org/token")
+		for label := range oldLabels {
+			delete(codiusService.Labels, label)
+		}
+		if codiusService.Labels == nil {
+			codiusService.Labels = map[string]string{}
+		}
+		codiusService.Labels[newLabel] = "true"
+		if err := api.Patch(req.Context(), codiusService, patch); err != nil {
+			api.Log.Error(err, "Failed to rotate token", "Service.Name", codiusService.Name)
+			writeAPIError(rw, err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// bearerToken returns the token of the request's Authorization header
+func bearerToken(req *http.Request) (string, error) {
+	authHeader := req.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", errors.New("Authorization header is required")
+	}
+	authHeaderParts := strings.Fields(authHeader)
+	if len(authHeaderParts) != 2 || strings.ToLower(authHeaderParts[0]) != "bearer" {
+		return "", errors.New("Authorization header format must be Bearer {token}")
+	}
+	return authHeaderParts[1], nil
+}
+
 func (api *ServicesApi) Start(stopCh <-chan struct{}) error {
 	svr := api.start()
 	defer api.stop(svr)
@@ -133,18 +721,103 @@ func (api *ServicesApi) Start(stopCh <-chan struct{}) error {
 	return nil
 }
 
-func (api *ServicesApi) start() *http.Server {
+func (api *ServicesApi) routes() []route {
+	listQuery := []parameter{
+		{in: "query", name: "labelSelector", typ: "string", description: "A label selector the services must match"},
+		{in: "query", name: "limit", typ: "integer", description: "The maximum number of services to return"},
+		{in: "query", name: "continue", typ: "string", description: "The continue token of the previous page"},
+	}
+	preconditions := []parameter{
+		{in: "header", name: "If-Match", typ: "string", description: "Replace the service only if its ETag matches, or if it exists for *"},
+		{in: "header", name: "If-None-Match", typ: "string", description: "Create the service only if it doesn't exist, for *"},
+	}
+	return []route{
+		{"GET", "/services", api.listServices(), operation{
+			id: "listServices", summary: "List the requester's services",
+			auth: authRequired, parameters: listQuery, statuses: []int{http.StatusOK}, response: servicesapi.ServiceList{},
+		}},
+		{"GET", "/services/:name", api.getService(), operation{
+			id: "getService", summary: "Get a service",
+			statuses: []int{http.StatusOK}, response: v1alpha1.Service{},
+		}},
+		{"PUT", "/services/:name", api.createOrReplaceService(), operation{
+			id: "createOrReplaceService", summary: "Create or replace a service",
+			auth: authRequired, parameters: preconditions, request: servicesapi.Service{},
+			statuses: []int{http.StatusCreated, http.StatusOK}, response: v1alpha1.Service{},
+		}},
+		{"DELETE", "/services/:name", api.deleteService(), operation{
+			id: "deleteService", summary: "Delete a service",
+			auth: authRequired, statuses: []int{http.StatusNoContent},
+		}},
+		{"GET", "/services/:name/usage", api.getServiceUsage(), operation{
+			id: "getServiceUsage", summary: "Get the usage of a service",
+			auth: authRequired, statuses: []int{http.StatusOK}, response: v1alpha1.ServiceUsage{},
+		}},
+		{"PUT", "/services/:name/token", api.rotateServiceToken(), operation{
+			id: "rotateServiceToken", summary: "Rotate the token of a service",
+			auth: authToken, request: servicesapi.TokenRotation{}, statuses: []int{http.StatusNoContent},
+		}},
+		{"GET", "/services/:name/balance", api.getServiceBalance(), operation{
+			id: "getServiceBalance", summary: "Get the balance of a service",
+			auth: authRequired, statuses: []int{http.StatusOK}, response: servicesapi.Balance{},
+		}},
+		{"POST", "/services/:name/balance", api.topUpServiceBalance(), operation{
+			id: "topUpServiceBalance", summary: "Top up the balance of a service with a base64 encoded STREAM receipt",
+			request: "", statuses: []int{http.StatusOK}, response: servicesapi.Balance{},
+		}},
+	}
+}
+
+// Handler returns the handler of the Services API's routes and its OpenAPI
+// document at /openapi.json
+func (api *ServicesApi) Handler() http.Handler {
+	api.ownerLimiter = newRateLimiter("SERVICES_API_OWNER_RATE_LIMIT", 5)
+	api.signatures = newSignatureCache()
 	router := httprouter.New()
-	router.GET("/services/:name", api.getService())
-	router.PUT("/services/:name", api.createOrReplaceService())
+	routes := api.routes()
+	for _, r := range routes {
+		router.Handle(r.method, r.path, r.handle)
+	}
+	router.GET("/openapi.json", serveOpenAPI(routes))
 	c := cors.New(cors.Options{
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
-		AllowedMethods:   []string{"GET", "PUT"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "Date", "Digest", "Signature", "If-Match", "If-None-Match"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE"},
+		ExposedHeaders:   []string{"ETag", "Location", "Retry-After"},
 		AllowCredentials: true,
 	})
+	return chain(c.Handler(router),
+		withLimits(newRateLimiter("SERVICES_API_RATE_LIMIT", 10)),
+	)
+}
+
+// withLimits rejects requests exceeding the rate limit per client IP, before
+// they're authenticated, and requests whose bodies are too large
+func withLimits(ipLimiter *rateLimiter) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if ok, delay := ipLimiter.allow(clientIP(req)); !ok {
+				setRetryAfter(rw, delay)
+				writeError(rw, http.StatusTooManyRequests, "Rate limit exceeded")
+				return
+			}
+			if req.ContentLength > maxRequestSize {
+				writeError(rw, http.StatusRequestEntityTooLarge, "")
+				return
+			}
+			req.Body = http.MaxBytesReader(rw, req.Body, maxRequestSize)
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+func (api *ServicesApi) start() *http.Server {
 	srv := &http.Server{
-		Addr:    api.BindAddress,
-		Handler: c.Handler(router),
+		Addr:              api.BindAddress,
+		Handler:           api.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
 	}
 	go func() {
 		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
@@ -0,0 +1,165 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package servers
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/codius/codius-operator/api/v1alpha1"
+)
+
+var _ = Describe("ServicesApi", func() {
+	var (
+		verifier  *httptest.Server
+		available bool
+		k8sClient client.Client
+		handler   http.Handler
+	)
+
+	BeforeEach(func() {
+		// The receipt verifier has a balance of 100 for every account, and
+		// credits valid receipts with 50
+		available = true
+		verifier = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			switch {
+			case !available:
+				rw.WriteHeader(http.StatusServiceUnavailable)
+			case strings.HasSuffix(req.URL.Path, ":creditReceipt") && string(body) == "receipt":
+				rw.Write([]byte("150"))
+			case strings.HasSuffix(req.URL.Path, ":creditReceipt"):
+				http.Error(rw, "invalid receipt", http.StatusBadRequest)
+			case req.Method == "GET":
+				rw.Write([]byte("100"))
+			}
+		}))
+		os.Setenv("RECEIPT_VERIFIER_URL", verifier.URL)
+		os.Setenv("SERVICES_API_RATE_LIMIT", "0")
+		os.Setenv("SERVICES_API_OWNER_RATE_LIMIT", "0")
+
+		hash, err := v1alpha1.HashToken("secret")
+		Expect(err).NotTo(HaveOccurred())
+		balance := int64(0)
+		k8sClient = fake.NewFakeClientWithScheme(scheme, &v1alpha1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "hello",
+				Annotations: map[string]string{
+					v1alpha1.TokenHashAnnotation: hash,
+				},
+			},
+			Status: v1alpha1.ServiceStatus{
+				Balance:   &balance,
+				Suspended: true,
+				Usage: &v1alpha1.ServiceUsage{
+					Requests: 3,
+					Billed:   30,
+				},
+			},
+		})
+		handler = (&ServicesApi{
+			Client: k8sClient,
+			Log:    logf.Log.WithName("servers").WithName("Services API"),
+		}).Handler()
+	})
+
+	AfterEach(func() {
+		verifier.Close()
+	})
+
+	do := func(method, path, token, body string) (*http.Response, []byte) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		resp := rw.Result()
+		data, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return resp, data
+	}
+
+	It("serves usage only to the owner", func() {
+		resp, body := do("GET", "/services/hello/usage", "secret", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		var usage v1alpha1.ServiceUsage
+		Expect(json.Unmarshal(body, &usage)).To(Succeed())
+		Expect(usage.Requests).To(Equal(int64(3)))
+		Expect(usage.Billed).To(Equal(int64(30)))
+
+		resp, _ = do("GET", "/services/hello/usage", "", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		resp, _ = do("GET", "/services/hello/usage", "other", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+	})
+
+	It("serves balances only to the owner", func() {
+		resp, body := do("GET", "/services/hello/balance", "secret", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(MatchJSON(`{"balance":100}`))
+
+		resp, _ = do("GET", "/services/hello/balance", "", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		resp, _ = do("GET", "/services/hello/balance", "other", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+	})
+
+	It("tops up balances and resumes suspended services", func() {
+		resp, body := do("POST", "/services/hello/balance", "", "receipt")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(MatchJSON(`{"balance":150}`))
+
+		var codiusService v1alpha1.Service
+		Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "hello"}, &codiusService)).To(Succeed())
+		Expect(codiusService.Status.Suspended).To(BeFalse())
+		Expect(*codiusService.Status.Balance).To(Equal(int64(150)))
+	})
+
+	It("rejects invalid receipts", func() {
+		resp, _ := do("POST", "/services/hello/balance", "", "forged")
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		resp, _ = do("POST", "/services/hello/balance", "", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		resp, _ = do("POST", "/services/unknown/balance", "", "receipt")
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+
+		var codiusService v1alpha1.Service
+		Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "hello"}, &codiusService)).To(Succeed())
+		Expect(codiusService.Status.Suspended).To(BeTrue())
+	})
+
+	It("responds 503 if payments are unavailable", func() {
+		available = false
+		resp, _ := do("GET", "/services/hello/balance", "secret", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		available = true
+	})
+})
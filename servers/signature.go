@@ -0,0 +1,167 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package servers
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codius/codius-operator/api/v1alpha1"
+)
+
+// maxSignatureSkew is how far the Date of a signed request may be from now
+const maxSignatureSkew = 5 * time.Minute
+
+// verifySignature verifies the request's Signature header, an HTTP message
+// signature made with an Ed25519 key, returning the key's base64url encoded
+// public key. The signature must cover the request target, Host and Date
+// headers, and the Digest header of a request with a body.
+func verifySignature(req *http.Request, body []byte, now time.Time) (string, error) {
+	params := parseSignature(req.Header.Get("Signature"))
+	keyID := params["keyId"]
+	publicKey, err := v1alpha1.ParseOwnerKey(keyID)
+	if err != nil {
+		return "", fmt.Errorf("Signature keyId must be a base64url encoded Ed25519 public key: %w", err)
+	}
+	if algorithm := params["algorithm"]; algorithm != "" && algorithm != "ed25519" && algorithm != "hs2019" {
+		return "", fmt.Errorf("Signature algorithm %q is not supported", algorithm)
+	}
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return "", errors.New("Signature signature must be a base64 encoded Ed25519 signature")
+	}
+
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	required := []string{"(request-target)", "host", "date"}
+	if len(body) > 0 {
+		required = append(required, "digest")
+	}
+	for _, header := range required {
+		if !containsString(headers, header) {
+			return "", fmt.Errorf("Signature headers must include %s", header)
+		}
+	}
+
+	date, err := http.ParseTime(req.Header.Get("Date"))
+	if err != nil {
+		return "", errors.New("Date header is required")
+	}
+	if skew := now.Sub(date); skew > maxSignatureSkew || skew < -maxSignatureSkew {
+		return "", errors.New("Date header is too far from the current time")
+	}
+	if containsString(headers, "digest") && !verifyDigest(req.Header.Get("Digest"), body) {
+		return "", errors.New("Digest header does not match the request body")
+	}
+
+	lines := make([]string, len(headers))
+	for i, header := range headers {
+		var value string
+		switch header {
+		case "(request-target)":
+			value = strings.ToLower(req.Method) + " " + req.URL.RequestURI()
+		case "host":
+			value = req.Host
+		default:
+			values, ok := req.Header[http.CanonicalHeaderKey(header)]
+			if !ok {
+				return "", fmt.Errorf("Signed header %s is missing", header)
+			}
+			value = strings.Join(values, ", ")
+		}
+		lines[i] = header + ": " + value
+	}
+	if !ed25519.Verify(publicKey, []byte(strings.Join(lines, "\n")), signature) {
+		return "", errors.New("Signature is invalid")
+	}
+	return keyID, nil
+}
+
+// signatureCache remembers the signatures of requests for as long as their
+// Date is accepted, so that captured requests can't be replayed
+type signatureCache struct {
+	mu        sync.Mutex
+	expiry    map[string]time.Time
+	lastSweep time.Time
+}
+
+func newSignatureCache() *signatureCache {
+	return &signatureCache{expiry: map[string]time.Time{}}
+}
+
+// add records the key's signature, returning false if it was already seen
+func (c *signatureCache) add(keyID, signature string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSweep) > maxSignatureSkew {
+		for k, expiry := range c.expiry {
+			if now.After(expiry) {
+				delete(c.expiry, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	k := keyID + " " + signature
+	if expiry, ok := c.expiry[k]; ok && !now.After(expiry) {
+		return false
+	}
+	// A Date up to the skew ahead of now is accepted until twice the skew from now
+	c.expiry[k] = now.Add(2 * maxSignatureSkew)
+	return true
+}
+
+// parseSignature returns the parameters of a Signature header
+func parseSignature(header string) map[string]string {
+	params := map[string]string{}
+	for _, param := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		params[parts[0]] = strings.Trim(parts[1], `"`)
+	}
+	return params
+}
+
+// verifyDigest reports whether the Digest header has the SHA-256 digest of
+// the body
+func verifyDigest(header string, body []byte) bool {
+	digest := sha256.Sum256(body)
+	expected := base64.StdEncoding.EncodeToString(digest[:])
+	for _, value := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(value), "=", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], "SHA-256") && parts[1] == expected {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
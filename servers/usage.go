@@ -0,0 +1,154 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package servers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codius/codius-operator/api/v1alpha1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+// usageFlushInterval is how often accounted usage is added to service status
+const usageFlushInterval = time.Minute
+
+type usage struct {
+	requests int64
+	bytesIn  int64
+	bytesOut int64
+	billed   int64
+}
+
+// usageTracker accumulates usage per service until it is flushed
+type usageTracker struct {
+	mu      sync.Mutex
+	pending map[string]*usage
+}
+
+func (t *usageTracker) add(serviceName string, delta usage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending == nil {
+		t.pending = map[string]*usage{}
+	}
+	u, ok := t.pending[serviceName]
+	if !ok {
+		u = &usage{}
+		t.pending[serviceName] = u
+	}
+	u.requests += delta.requests
+	u.bytesIn += delta.bytesIn
+	u.bytesOut += delta.bytesOut
+	u.billed += delta.billed
+}
+
+// take returns and resets the pending usage
+func (t *usageTracker) take() map[string]*usage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pending := t.pending
+	t.pending = nil
+	return pending
+}
+
+// parseAmount parses a price, returning 0 if it isn't an integer amount
+func parseAmount(price string) int64 {
+	amount, err := strconv.ParseInt(price, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return amount
+}
+
+// withUsage accounts the request and the bytes received and sent. Bytes sent
+// over upgraded connections after the handshake aren't counted.
+func (proxy *Proxy) withUsage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body := &countingReader{ReadCloser: req.Body}
+		if req.Body != nil {
+			req.Body = body
+		}
+		recorder := &responseRecorder{ResponseWriter: rw}
+		next.ServeHTTP(recorder, req)
+		proxy.usage.add(getRequestInfo(req.Context()).serviceName, usage{
+			requests: 1,
+			bytesIn:  atomic.LoadInt64(&body.read),
+			bytesOut: recorder.written,
+		})
+	})
+}
+
+// reportUsage flushes accounted usage every usageFlushInterval until stopped
+func (proxy *Proxy) reportUsage(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			proxy.flushUsage(context.Background())
+		}
+	}
+}
+
+// flushUsage adds the pending usage to each Codius service's status. Usage
+// which fails to be recorded is kept for the next flush.
+func (proxy *Proxy) flushUsage(ctx context.Context) {
+	for serviceName, u := range proxy.usage.take() {
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			var codiusService v1alpha1.Service
+			if err := proxy.Get(ctx, types.NamespacedName{Name: serviceName, Namespace: ""}, &codiusService); err != nil {
+				return err
+			}
+			if codiusService.Status.Usage == nil {
+				codiusService.Status.Usage = &v1alpha1.ServiceUsage{}
+			}
+			codiusService.Status.Usage.Requests += u.requests
+			codiusService.Status.Usage.BytesIn += u.bytesIn
+			codiusService.Status.Usage.BytesOut += u.bytesOut
+			codiusService.Status.Usage.Billed += u.billed
+			codiusService.Status.Usage.UpdateTime = &metav1.Time{Time: time.Now()}
+			return proxy.Status().Update(ctx, &codiusService)
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			proxy.Log.Error(err, "Failed to update usage", "Service.Name", serviceName)
+			proxy.usage.add(serviceName, *u)
+		}
+	}
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(&r.read, int64(n))
+	return n, err
+}
@@ -0,0 +1,76 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package servicesapi defines the request and response bodies of the Codius
+// Services API, which are shared by its server and clients.
+package servicesapi
+
+import (
+	"github.com/codius/codius-operator/api/v1alpha1"
+)
+
+// Service is the request body which creates or replaces a service
+type Service struct {
+	Spec       v1alpha1.ServiceSpec
+	SecretData map[string]string
+	Domains    []string
+	AlwaysOn   bool
+	OwnerKeys  []string
+}
+
+// ServiceList is a page of services
+type ServiceList struct {
+	Items []*v1alpha1.Service `json:"items"`
+	// Continue is the token with which to list the next page, if any
+	Continue string `json:"continue,omitempty"`
+}
+
+// Balance is the amount remaining in a service's balance
+type Balance struct {
+	Balance int64 `json:"balance"`
+}
+
+// TokenRotation is the new token of a service
+type TokenRotation struct {
+	Token string `json:"token"`
+}
+
+// Error is the body of Services API error responses
+type Error struct {
+	// Code is the HTTP status code of the response
+	Code int `json:"code"`
+	// Reason is a machine readable description of the error, such as
+	// "Forbidden" or "PaymentRequired"
+	Reason string `json:"reason"`
+	// Message is a human readable description of the error
+	Message string `json:"message"`
+	// Causes lists the fields of the service which failed validation
+	Causes []ErrorCause `json:"causes,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrorCause describes a field of the service which failed validation
+type ErrorCause struct {
+	// Type is the type of validation failure, such as "FieldValueInvalid"
+	Type string `json:"type"`
+	// Field is the path of the field, such as "spec.ports[0].name"
+	Field string `json:"field,omitempty"`
+	// Message describes the failure
+	Message string `json:"message"`
+}